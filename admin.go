@@ -0,0 +1,698 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Count returns the number of stored sessions. The count may include sessions
+// that have expired but not yet been removed; MongoDB's TTL monitor only runs
+// about once a minute.
+func (m *MongoStore) Count(ctx context.Context) (int64, error) {
+	return m.CountWhere(ctx, bson.M{})
+}
+
+// CountWhere returns the number of stored sessions matching filter. Like
+// Count, it may include expired sessions the TTL monitor has not reaped yet.
+// SoftDelete tombstones are left out unless filter selects on deleted_at.
+func (m *MongoStore) CountWhere(ctx context.Context, filter bson.M) (int64,
+	error) {
+	return m.coll.Find(ctx, m.live(filter)).Count()
+}
+
+// StoreStats are aggregate statistics of the stored sessions.
+type StoreStats struct {
+	// Sessions is the number of stored sessions, including any expired ones
+	// the TTL monitor has not removed yet.
+	Sessions int64
+	// Oldest and Newest are the earliest and latest modified times, zero
+	// when there are no sessions.
+	Oldest time.Time
+	Newest time.Time
+	// ApproxDataBytes is the sum of the lengths of the data fields. It is
+	// not the size on disk, which adds the other fields, indexes and
+	// storage overhead, less compression.
+	ApproxDataBytes int64
+}
+
+// Stats returns statistics of the stored sessions, computed by the server in a
+// single aggregation over the collection.
+func (m *MongoStore) Stats(ctx context.Context) (StoreStats, error) {
+	f := m.fields()
+	var res struct {
+		Sessions        int64     `bson:"sessions"`
+		Oldest          time.Time `bson:"oldest"`
+		Newest          time.Time `bson:"newest"`
+		ApproxDataBytes int64     `bson:"data_bytes"`
+	}
+	pipeline := bson.A{bson.M{"$match": m.live(bson.M{})}}
+	err := m.coll.Aggregate(ctx, append(pipeline, bson.M{"$group": bson.M{
+		"_id":      nil,
+		"sessions": bson.M{"$sum": 1},
+		"oldest":   bson.M{"$min": "$" + f.Modified},
+		"newest":   bson.M{"$max": "$" + f.Modified},
+		"data_bytes": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": "$" + f.Data}, "string"}},
+			bson.M{"$strLenBytes": "$" + f.Data},
+			0,
+		}}},
+	}})).One(&res)
+	if err == qmgo.ErrNoSuchDocuments {
+		return StoreStats{}, nil
+	}
+	if err != nil {
+		return StoreStats{}, err
+	}
+	return StoreStats(res), nil
+}
+
+// defaultMaxListLimit is used by List when MaxListLimit is zero.
+const defaultMaxListLimit = 1000
+
+// List returns up to limit stored sessions, most recently modified first,
+// after skipping skip of them. limit is capped at MaxListLimit; zero means
+// the cap. Values are returned still encoded, as stored.
+func (m *MongoStore) List(ctx context.Context, skip, limit int64) ([]Session,
+	error) {
+	if skip < 0 || limit < 0 {
+		return nil, errors.New("mongo-store: negative skip or limit")
+	}
+	max := m.MaxListLimit
+	if max <= 0 {
+		max = defaultMaxListLimit
+	}
+	if limit == 0 || limit > max {
+		limit = max
+	}
+
+	var raw []bson.M
+	err := m.coll.Find(ctx, m.live(bson.M{})).Sort("-" + m.fields().Modified).
+		Skip(skip).Limit(limit).All(&raw)
+	if err != nil {
+		return nil, err
+	}
+	return m.fromStoredAll(raw)
+}
+
+// FindByField returns the sessions whose IndexedFields entry field has the
+// given value.
+func (m *MongoStore) FindByField(ctx context.Context, field, value string) (
+	[]Session, error) {
+	if !m.isIndexedField(field) {
+		return nil, fmt.Errorf("mongo-store: %q is not an indexed field", field)
+	}
+
+	var raw []bson.M
+	if err := m.coll.Find(ctx, m.live(bson.M{field: value})).All(&raw); err != nil {
+		return nil, err
+	}
+	return m.fromStoredAll(raw)
+}
+
+// IDsByField is like FindByField but returns only the session IDs, fetching
+// nothing else from the server. Pass them to DeleteByID to log the sessions
+// out.
+func (m *MongoStore) IDsByField(ctx context.Context, field, value string) (
+	[]string, error) {
+	if !m.isIndexedField(field) {
+		return nil, fmt.Errorf("mongo-store: %q is not an indexed field", field)
+	}
+
+	f := m.fields()
+	projection := bson.M{f.ID: 1}
+	if f.ID != "_id" {
+		projection["_id"] = 0
+	}
+	var raw []bson.M
+	if err := m.coll.Find(ctx, m.live(bson.M{field: value})).Select(projection).
+		All(&raw); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(raw))
+	for _, r := range raw {
+		s, err := m.fromStored(r)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// SessionInfo is the display metadata of a stored session.
+type SessionInfo struct {
+	ID       string
+	Created  time.Time
+	Modified time.Time
+	// Expires is the stored expires_at or, for a session written without
+	// it, computed from Modified and Options.MaxAge. It is zero if the
+	// session does not expire.
+	Expires time.Time
+	// IP and UserAgent identify the client of the last Save, if the store
+	// has RecordClient set.
+	IP        string
+	UserAgent string
+}
+
+// InfoByUserID returns the metadata of every session whose UserIDKey value is
+// userID, for example to list a user's active sessions. The session values
+// are not fetched.
+func (m *MongoStore) InfoByUserID(ctx context.Context, userID string) (
+	[]SessionInfo, error) {
+	if userID == "" {
+		return nil, errors.New("mongo-store: empty user id")
+	}
+
+	f := m.fields()
+	var raw []bson.M
+	err := m.coll.Find(ctx, m.live(bson.M{"user_id": userID})).Select(bson.M{
+		f.ID: 1, f.Modified: 1, "created": 1, "expires_at": 1, "ip": 1,
+		"user_agent": 1,
+	}).All(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]SessionInfo, 0, len(raw))
+	for _, r := range raw {
+		s, err := m.fromStored(r)
+		if err != nil {
+			return nil, err
+		}
+		info := SessionInfo{
+			ID:        s.ID,
+			Created:   s.Created,
+			Modified:  s.Modified,
+			Expires:   s.ExpiresAt,
+			IP:        s.IP,
+			UserAgent: s.UserAgent,
+		}
+		if maxAge := m.maxAge(); info.Expires.IsZero() && maxAge > 0 {
+			info.Expires = s.Modified.Add(
+				time.Duration(ttlSeconds(maxAge)) * time.Second)
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// DeleteByUserID deletes every session whose UserIDKey value is userID, for
+// example to log a user out everywhere, and returns how many were removed.
+func (m *MongoStore) DeleteByUserID(ctx context.Context, userID string) (int64,
+	error) {
+	if userID == "" {
+		return 0, errors.New("mongo-store: empty user id")
+	}
+
+	if m.Cache != nil {
+		infos, err := m.InfoByUserID(ctx, userID)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			for _, info := range infos {
+				m.uncache(info.ID)
+			}
+		}()
+	}
+
+	res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{"user_id": userID}))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// Prune deletes sessions whose modified time is more than olderThan ago and
+// returns how many were removed. Use it where the TTL index is not created or
+// the TTL monitor is disabled.
+func (m *MongoStore) Prune(ctx context.Context, olderThan time.Duration) (int64,
+	error) {
+	res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{
+		m.fields().Modified: bson.M{"$lt": m.now().Add(-olderThan)},
+	}))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// DeleteExpired deletes sessions whose expires_at is past, and sessions
+// written without expires_at whose modified time is more than Options.MaxAge
+// seconds ago, and returns how many were removed. It forces the cleanup the
+// TTL monitor would eventually do.
+func (m *MongoStore) DeleteExpired(ctx context.Context) (int64, error) {
+	now := m.now()
+	expired := []bson.M{{"expires_at": bson.M{"$lt": now}}}
+	if age := m.maxAge(); age > 0 {
+		maxAge := time.Duration(ttlSeconds(age)) * time.Second
+		expired = append(expired, bson.M{
+			"expires_at":        bson.M{"$exists": false},
+			m.fields().Modified: bson.M{"$lt": now.Add(-maxAge)},
+		})
+	}
+
+	res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{"$or": expired}))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// Clear deletes every document in the collection, logging out all users, and
+// returns how many were removed. It is destructive and cannot be undone; in a
+// collection shared with other data, that data is deleted too. With a
+// Namespace, only the sessions in it are deleted.
+func (m *MongoStore) Clear(ctx context.Context) (int64, error) {
+	res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{}))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// DeleteByID deletes the session stored under the ID id. It returns
+// ErrInvalidId if id is malformed and ErrSessionNotFound if no session is
+// stored under it.
+func (m *MongoStore) DeleteByID(ctx context.Context, id string) error {
+	return m.deleteID(ctx, id)
+}
+
+// DeleteByIDs deletes the sessions stored under ids in a single delete and
+// returns how many were removed. Malformed IDs are skipped and, once the
+// others are deleted, reported in an error matching ErrInvalidId.
+func (m *MongoStore) DeleteByIDs(ctx context.Context, ids []string) (int64,
+	error) {
+	var keys []interface{}
+	var invalid []string
+	for _, id := range ids {
+		key, err := m.parseID(id)
+		if err != nil {
+			invalid = append(invalid, strconv.Quote(id))
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	var n int64
+	if len(keys) > 0 {
+		defer m.uncache(ids...)
+		res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{
+			m.fields().ID: bson.M{"$in": keys},
+		}))
+		if err != nil {
+			return 0, err
+		}
+		n = res.DeletedCount
+	}
+	if len(invalid) > 0 {
+		return n, fmt.Errorf("%w, skipped %s", ErrInvalidId,
+			strings.Join(invalid, ", "))
+	}
+	return n, nil
+}
+
+// FindSession returns the stored document for the ID id without decoding
+// its values, including a SoftDelete tombstone, which has DeletedAt set. It
+// returns ErrInvalidId if id is malformed and ErrSessionNotFound if no
+// session is stored under it.
+func (m *MongoStore) FindSession(ctx context.Context, id string) (*Session,
+	error) {
+	key, err := m.parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.find(ctx, key, nil, nil)
+}
+
+// Exists reports whether a session is stored under the ID id, fetching only
+// the ID so nothing is decoded. A missing session is false with no error; a
+// session that has expired but not yet been removed still exists, which
+// IsExpired tells apart. A SoftDelete tombstone does not exist. It returns
+// ErrInvalidId if id is malformed.
+func (m *MongoStore) Exists(ctx context.Context, id string) (bool, error) {
+	key, err := m.parseID(id)
+	if err != nil {
+		return false, err
+	}
+	_, err = m.findLive(ctx, key, bson.M{m.fields().ID: 1}, nil)
+	if err == ErrSessionNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IsExpired reports whether the session stored under the ID id has expired,
+// fetching only its timestamps. A session written without expires_at expires
+// Options.MaxAge seconds after it was modified, as in DeleteExpired. It
+// returns ErrInvalidId if id is malformed and ErrSessionNotFound if no session
+// is stored under it, whether it never existed or has been removed.
+func (m *MongoStore) IsExpired(ctx context.Context, id string) (bool, error) {
+	key, err := m.parseID(id)
+	if err != nil {
+		return false, err
+	}
+	s, err := m.findLive(ctx, key, bson.M{
+		m.fields().Modified: 1, "created": 1, "expires_at": 1,
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if m.expired(s) {
+		return true, nil
+	}
+	if age := m.maxAge(); s.ExpiresAt.IsZero() && age > 0 {
+		maxAge := time.Duration(ttlSeconds(age)) * time.Second
+		return m.now().Sub(s.Modified) > maxAge, nil
+	}
+	return false, nil
+}
+
+// FindValues returns the decoded values of the session stored under the
+// ID id. name is the session name it was saved with, which the codecs need to
+// verify the payload.
+func (m *MongoStore) FindValues(ctx context.Context, name, id string) (
+	map[interface{}]interface{}, error) {
+	s, err := m.findLiveID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	session := sessions.NewSession(m, name)
+	session.ID = id
+	if err = m.decode(ctx, s, session); err != nil {
+		return nil, err
+	}
+	return session.Values, nil
+}
+
+// UpdateValues loads the values of the session stored under the ID id, passes
+// them to mutate and writes the result back, for changing a session outside
+// a request. name is the session name it was saved with, which the codecs
+// need. If mutate returns an error nothing is written.
+//
+// The write only succeeds if the session was not saved in between, else it
+// returns ErrConcurrentModification and the caller may try again; a request
+// saving the session afterwards still overwrites the change with the values
+// it loaded earlier.
+func (m *MongoStore) UpdateValues(ctx context.Context, name, id string,
+	mutate func(values map[interface{}]interface{}) error) (err error) {
+	ctx, end := m.startOp(ctx, "upsert", id)
+	defer func() { end(err) }()
+
+	key, err := m.parseID(id)
+	if err != nil {
+		return err
+	}
+	prev, err := m.findLive(ctx, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	session := sessions.NewSession(m, name)
+	session.ID = id
+	if err = m.decode(ctx, prev, session); err != nil {
+		return err
+	}
+	if err = mutate(session.Values); err != nil {
+		return err
+	}
+	if m.OptimisticLocking {
+		session.Values[versionKey{}] = prev.Version
+	}
+
+	s, err := m.document(ctx, session)
+	if err != nil {
+		return err
+	}
+	s.IP, s.UserAgent = prev.IP, prev.UserAgent
+	defer m.uncache(id)
+	return m.retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		return m.writeGuarded(ctx, key, bson.M{
+			m.fields().Modified: prev.Modified,
+		}, m.update(s))
+	})
+}
+
+// SaveField sets the single session value key of the session id to value,
+// leaving its other values and the rest of the document untouched, so a
+// small counter next to large stable values does not rewrite them all. It
+// requires RawValues, where each value is its own field of the values
+// subdocument, and key must be usable as a field name: not empty, without
+// dots and not starting with "$". The fields copied from UserIDKey and
+// IndexedFields follow the value.
+//
+// The session's modified time and expiry are not changed. With
+// OptimisticLocking the version is bumped, so a request that loaded the
+// session earlier fails to save over the change; without it, that save
+// overwrites it, as it does for UpdateValues. MaxValueBytes is not checked.
+// It returns ErrSessionNotFound if there is no session id, or only a
+// SoftDelete tombstone.
+func (m *MongoStore) SaveField(ctx context.Context, id, key string,
+	value interface{}) (err error) {
+	ctx, end := m.startOp(ctx, "upsert", id)
+	defer func() { end(err) }()
+
+	if !m.RawValues {
+		return errors.New("mongo-store: SaveField requires RawValues")
+	}
+	if err = checkFieldKey(key); err != nil {
+		return err
+	}
+	dbKey, err := m.parseID(id)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{"values." + key: value}
+	update := bson.M{"$set": set}
+	if key == m.UserIDKey {
+		session := sessions.NewSession(m, "")
+		session.Values[key] = value
+		if userID := m.userID(session); userID != "" {
+			set["user_id"] = userID
+		} else {
+			update["$unset"] = bson.M{"user_id": ""}
+		}
+	}
+	if m.isIndexedField(key) {
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("mongo-store: indexed field %q holds %T, "+
+				"want string", key, value)
+		}
+		set[key] = str
+	}
+	if m.OptimisticLocking {
+		update["$inc"] = bson.M{"version": int64(1)}
+	}
+
+	defer m.uncache(id)
+	return m.retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		c, err := m.concernCollection(nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.UpdateOne(ctx, m.liveIDFilter(dbKey), update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrSessionNotFound
+		}
+		return nil
+	})
+}
+
+// checkFieldKey checks that the session value key can be used as the name
+// of a field of the values subdocument.
+func checkFieldKey(key string) error {
+	if key == "" || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+		return fmt.Errorf("mongo-store: session value key %q cannot be "+
+			"saved as a field", key)
+	}
+	return nil
+}
+
+// Increment atomically adds delta to the numeric session value key of the
+// session id and returns the new total, so counters such as a rate limit
+// stay correct under concurrent requests. A missing value counts as zero;
+// any other non-numeric one fails the update. Like SaveField, it requires
+// RawValues, leaves the session's other values, modified time and expiry
+// alone, bumps the version with OptimisticLocking and returns
+// ErrSessionNotFound if there is no session id. A request saving a session
+// it loaded earlier overwrites the count.
+func (m *MongoStore) Increment(ctx context.Context, id, key string,
+	delta int64) (total int64, err error) {
+	ctx, end := m.startOp(ctx, "upsert", id)
+	defer func() { end(err) }()
+
+	if !m.RawValues {
+		return 0, errors.New("mongo-store: Increment requires RawValues")
+	}
+	if err = checkFieldKey(key); err != nil {
+		return 0, err
+	}
+	dbKey, err := m.parseID(id)
+	if err != nil {
+		return 0, err
+	}
+
+	inc := bson.M{"values." + key: delta}
+	if m.OptimisticLocking {
+		inc["version"] = int64(1)
+	}
+	var next struct {
+		Values map[string]interface{} `bson:"values"`
+	}
+	defer m.uncache(id)
+	err = m.retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		c, err := m.concernCollection(nil)
+		if err != nil {
+			return err
+		}
+		err = c.FindOneAndUpdate(ctx, m.liveIDFilter(dbKey), bson.M{"$inc": inc},
+			mongoOpts.FindOneAndUpdate().
+				SetReturnDocument(mongoOpts.After).
+				SetProjection(bson.M{"values." + key: 1})).
+			Decode(&next)
+		if err == mongo.ErrNoDocuments {
+			return ErrSessionNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := next.Values[key].(type) {
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("mongo-store: session value %q holds %T, "+
+			"want a number", key, v)
+	}
+}
+
+// flashesKey is the session value under which gorilla/sessions keeps flash
+// messages added without a key.
+const flashesKey = "_flash"
+
+// PopFlashes returns the flash messages of session and removes them from
+// the stored document in the same round trip, so clearing them needs no
+// full Save. They are also removed from session.Values. It requires
+// RawValues, where the messages are a field of their own, and returns
+// ErrSessionNotFound if session is not stored or is a SoftDelete tombstone.
+func (m *MongoStore) PopFlashes(ctx context.Context,
+	session *sessions.Session) (flashes []interface{}, err error) {
+	m = m.forName(session.Name())
+	ctx, end := m.startOp(ctx, "upsert", session.ID)
+	defer func() { end(err) }()
+
+	if !m.RawValues {
+		return nil, errors.New("mongo-store: PopFlashes requires RawValues")
+	}
+	key, err := m.parseID(session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$unset": bson.M{"values." + flashesKey: ""}}
+	if m.OptimisticLocking {
+		update["$inc"] = bson.M{"version": int64(1)}
+	}
+	var prev struct {
+		Values map[string]interface{} `bson:"values"`
+	}
+	defer m.uncache(session.ID)
+	err = m.retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		c, err := m.concernCollection(nil)
+		if err != nil {
+			return err
+		}
+		err = c.FindOneAndUpdate(ctx, m.liveIDFilter(key), update,
+			mongoOpts.FindOneAndUpdate().
+				SetProjection(bson.M{"values." + flashesKey: 1})).
+			Decode(&prev)
+		if err == mongo.ErrNoDocuments {
+			return ErrSessionNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	delete(session.Values, flashesKey)
+	if version, ok := session.Values[versionKey{}].(int64); ok {
+		// The pop is this session's own write.
+		session.Values[versionKey{}] = version + 1
+	}
+	switch v := prev.Values[flashesKey].(type) {
+	case nil:
+		return nil, nil
+	case bson.A:
+		return []interface{}(v), nil
+	case []interface{}:
+		return v, nil
+	default:
+		return []interface{}{v}, nil
+	}
+}
+
+// Import stores a session under the given ID and values, as if it had been
+// saved at modified, for moving sessions over from another store without
+// logging users out. name is the session name it will be loaded under, which
+// the codecs bind the payload to. A zero modified means now. An existing
+// session with the same ID is replaced.
+func (m *MongoStore) Import(ctx context.Context, name, id string,
+	values map[interface{}]interface{}, modified time.Time) (err error) {
+	ctx, end := m.startOp(ctx, "upsert", id)
+	defer func() { end(err) }()
+
+	session := sessions.NewSession(m, name)
+	session.ID = id
+	for k, v := range values {
+		session.Values[k] = v
+	}
+
+	s, err := m.document(ctx, session)
+	if err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		s.Modified = modified
+		s.ExpiresAt = m.expiresAt(session, modified)
+	}
+
+	defer m.uncache(id)
+	return m.retry(ctx, func(ctx context.Context) error {
+		return m.write(ctx, s)
+	})
+}
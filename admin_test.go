@@ -0,0 +1,700 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMongoStoreCount(t *testing.T) {
+	store := mustNewWeakKeyStore(newTestCollection(t), 3600, false,
+		[]byte("secret-key"))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		saveTestSession(t, store, nil)
+	}
+
+	n, err := store.Count(context.Background())
+	if err != nil || n != 3 {
+		t.Errorf("Expected 3 sessions; Got %d, %v", n, err)
+	}
+
+	n, err = store.CountWhere(context.Background(),
+		bson.M{"modified": bson.M{"$lt": start}})
+	if err != nil || n != 0 {
+		t.Errorf("Expected 0 sessions before start; Got %d, %v", n, err)
+	}
+}
+
+func TestMongoStoreDeleteByUserID(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+
+	saveTestSession(t, store, map[interface{}]interface{}{"user_id": "alice"})
+	saveTestSession(t, store, map[interface{}]interface{}{"user_id": "alice"})
+	bob, _ := saveTestSession(t, store, map[interface{}]interface{}{"user_id": "bob"})
+	saveTestSession(t, store, nil)
+
+	n, err := store.DeleteByUserID(context.Background(), "alice")
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 sessions deleted; Got %d, %v", n, err)
+	}
+	if n, _ = store.Count(context.Background()); n != 2 {
+		t.Errorf("Expected 2 sessions left; Got %d", n)
+	}
+	if s := findTestSession(t, coll, bob.ID); s.UserID != "bob" {
+		t.Errorf("Expected user_id bob; Got %q", s.UserID)
+	}
+
+	if _, err = store.DeleteByUserID(context.Background(), ""); err == nil {
+		t.Errorf("Expected an error for an empty user id")
+	}
+}
+
+func TestMongoStorePrune(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+
+	now := time.Now()
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour} {
+		saveTestSessionAt(t, store, now.Add(-age), nil)
+	}
+	fresh, _ := saveTestSessionAt(t, store, now.Add(-time.Minute), nil)
+	current, _ := saveTestSession(t, store, nil)
+
+	n, err := store.Prune(context.Background(), time.Hour)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 sessions pruned; Got %d, %v", n, err)
+	}
+	findTestSession(t, coll, fresh.ID)
+	findTestSession(t, coll, current.ID)
+}
+
+func TestMongoStoreDeleteByID(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, nil)
+
+	err := store.DeleteByID(context.Background(), "nope")
+	var idErr *IDError
+	if !errors.Is(err, ErrInvalidId) || !errors.As(err, &idErr) || idErr.ID != "nope" {
+		t.Errorf("Expected ErrInvalidId for nope; Got %v", err)
+	}
+	if err := store.DeleteByID(context.Background(), session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if n, _ := store.Count(context.Background()); n != 0 {
+		t.Errorf("Expected no sessions left; Got %d", n)
+	}
+	if err := store.DeleteByID(context.Background(), session.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+}
+
+func TestMongoStoreFindSession(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	s, err := store.FindSession(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("Error finding session: %v", err)
+	}
+	if s.ID != session.ID || s.Data == "" || s.Modified.IsZero() {
+		t.Errorf("Unexpected stored session: %+v", s)
+	}
+
+	values, err := store.FindValues(context.Background(), "session-key", session.ID)
+	if err != nil {
+		t.Fatalf("Error finding values: %v", err)
+	}
+	if values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", values["user"])
+	}
+
+	if _, err = store.FindSession(context.Background(), "nope"); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("Expected ErrInvalidId; Got %v", err)
+	}
+	if _, err = store.FindValues(context.Background(), "session-key",
+		primitive.NewObjectID().Hex()); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+}
+
+func TestMongoStoreList(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.MaxListLimit = 2
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		session, _ := saveTestSessionAt(t, store,
+			time.Now().Add(time.Duration(i)*time.Minute), nil)
+		ids = append(ids, session.ID)
+	}
+
+	list, err := store.List(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatalf("Error listing sessions: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 sessions; Got %d", len(list))
+	}
+	if list[0].ID != ids[2] || list[1].ID != ids[1] {
+		t.Errorf("Expected newest first; Got %s, %s", list[0].ID,
+			list[1].ID)
+	}
+
+	list, err = store.List(context.Background(), 2, 0)
+	if err != nil {
+		t.Fatalf("Error listing sessions: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != ids[0] {
+		t.Errorf("Expected only %s; Got %v", ids[0], list)
+	}
+
+	if _, err = store.List(context.Background(), -1, 0); err == nil {
+		t.Error("Expected error for negative skip")
+	}
+}
+
+func TestMongoStoreDeleteExpired(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	fresh, _ := saveTestSession(t, store, nil)
+	expired, _ := saveTestSessionAt(t, store, now.Add(-2*time.Hour), nil)
+	legacy := primitive.NewObjectID()
+	if _, err := coll.InsertOne(context.Background(), bson.M{
+		"_id": legacy, "data": "x", "modified": now.Add(-2 * time.Hour),
+	}); err != nil {
+		t.Fatalf("Error inserting legacy session: %v", err)
+	}
+
+	n, err := store.DeleteExpired(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 deleted; Got %d, %v", n, err)
+	}
+	findTestSession(t, coll, fresh.ID)
+	for _, id := range []string{expired.ID, legacy.Hex()} {
+		if _, err = store.FindSession(context.Background(), id); err != ErrSessionNotFound {
+			t.Errorf("Expected %s to be deleted; Got %v", id, err)
+		}
+	}
+}
+
+func TestMongoStoreFindByField(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.IndexedFields = []string{"tenant_id", "device_id"}
+
+	acme, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"tenant_id": "acme", "device_id": "phone",
+	})
+	saveTestSession(t, store, map[interface{}]interface{}{"tenant_id": "other"})
+
+	list, err := store.FindByField(context.Background(), "tenant_id", "acme")
+	if err != nil {
+		t.Fatalf("Error finding sessions: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != acme.ID {
+		t.Errorf("Expected only %s; Got %v", acme.ID, list)
+	}
+
+	if _, err = store.FindByField(context.Background(), "user", "x"); err == nil {
+		t.Error("Expected error for a field that is not indexed")
+	}
+
+	ids, err := store.IDsByField(context.Background(), "device_id", "phone")
+	if err != nil {
+		t.Fatalf("Error finding session IDs: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != acme.ID {
+		t.Errorf("Expected only %s; Got %v", acme.ID, ids)
+	}
+	if _, err = store.IDsByField(context.Background(), "user", "x"); err == nil {
+		t.Error("Expected error for a field that is not indexed")
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "session-key")
+	session.Values["tenant_id"] = 42
+	if err = store.Save(req, httptest.NewRecorder(), session); err == nil ||
+		!strings.Contains(err.Error(), "tenant_id") {
+		t.Errorf("Expected error for a non-string indexed value; Got %v", err)
+	}
+}
+
+func TestMongoStoreImport(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+
+	id := primitive.NewObjectID().Hex()
+	modified := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	err := store.Import(context.Background(), "session-key", id,
+		map[interface{}]interface{}{"user": "gopher"}, modified)
+	if err != nil {
+		t.Fatalf("Error importing session: %v", err)
+	}
+	if s := findTestSession(t, coll, id); !s.Modified.Equal(modified) {
+		t.Errorf("Expected modified %v; Got %v", modified, s.Modified)
+	}
+
+	session := sessions.NewSession(store, "session-key")
+	session.ID = id
+	if err = store.load(context.Background(), session); err != nil {
+		t.Fatalf("Error loading imported session: %v", err)
+	}
+	if session.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", session.Values["user"])
+	}
+
+	if err = store.Import(context.Background(), "session-key", "nope", nil,
+		time.Time{}); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("Expected ErrInvalidId; Got %v", err)
+	}
+}
+
+func TestMongoStoreClear(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	for i := 0; i < 3; i++ {
+		saveTestSession(t, store, nil)
+	}
+
+	n, err := store.Clear(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 cleared; Got %d, %v", n, err)
+	}
+	if n, _ = store.Count(context.Background()); n != 0 {
+		t.Errorf("Expected no sessions left; Got %d", n)
+	}
+}
+
+func TestMongoStoreDeleteByIDs(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	a, _ := saveTestSession(t, store, nil)
+	b, _ := saveTestSession(t, store, nil)
+	kept, _ := saveTestSession(t, store, nil)
+
+	n, err := store.DeleteByIDs(context.Background(), []string{a.ID, "nope",
+		b.ID, primitive.NewObjectID().Hex()})
+	if n != 2 {
+		t.Errorf("Expected 2 deleted; Got %d", n)
+	}
+	if !errors.Is(err, ErrInvalidId) || !strings.Contains(err.Error(), `"nope"`) {
+		t.Errorf("Expected ErrInvalidId naming nope; Got %v", err)
+	}
+	if _, err = store.FindSession(context.Background(), kept.ID); err != nil {
+		t.Errorf("Expected %s to be kept; Got %v", kept.ID, err)
+	}
+
+	if n, err = store.DeleteByIDs(context.Background(), nil); n != 0 || err != nil {
+		t.Errorf("Expected nothing deleted; Got %d, %v", n, err)
+	}
+}
+
+func TestMongoStoreExists(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, nil)
+
+	ctx := context.Background()
+	if ok, err := store.Exists(ctx, session.ID); err != nil || !ok {
+		t.Errorf("Expected the saved session to exist; Got %v, %v", ok, err)
+	}
+	if ok, err := store.Exists(ctx, primitive.NewObjectID().Hex()); err != nil || ok {
+		t.Errorf("Expected false, nil for a missing session; Got %v, %v", ok, err)
+	}
+	if _, err := store.Exists(ctx, "not-hex"); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("Expected ErrInvalidId; Got %v", err)
+	}
+}
+
+func TestMongoStoreIsExpired(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	fresh, _ := saveTestSession(t, store, nil)
+	expired, _ := saveTestSessionAt(t, store, now.Add(-2*time.Hour), nil)
+	legacy := primitive.NewObjectID()
+	if _, err := coll.InsertOne(context.Background(), bson.M{
+		"_id": legacy, "data": "x", "modified": now.Add(-2 * time.Hour),
+	}); err != nil {
+		t.Fatalf("Error inserting legacy session: %v", err)
+	}
+
+	for id, want := range map[string]bool{
+		fresh.ID: false, expired.ID: true, legacy.Hex(): true,
+	} {
+		if got, err := store.IsExpired(context.Background(), id); err != nil ||
+			got != want {
+			t.Errorf("Expected %s expired %v; Got %v, %v", id, want, got, err)
+		}
+	}
+
+	if _, err := store.IsExpired(context.Background(),
+		primitive.NewObjectID().Hex()); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+}
+
+func TestMongoStoreInfoByUserID(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+
+	alice, _ := saveTestSession(t, store, map[interface{}]interface{}{"user_id": "alice"})
+	saveTestSession(t, store, map[interface{}]interface{}{"user_id": "bob"})
+
+	list, err := store.InfoByUserID(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("Error listing sessions: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != alice.ID {
+		t.Fatalf("Expected only %s; Got %v", alice.ID, list)
+	}
+	info := list[0]
+	if info.Created.IsZero() || !info.Expires.Equal(info.Modified.Add(time.Hour)) {
+		t.Errorf("Unexpected session info: %+v", info)
+	}
+
+	if _, err = store.InfoByUserID(context.Background(), ""); err == nil {
+		t.Errorf("Expected an error for an empty user id")
+	}
+}
+
+func TestMongoStoreUpdateValues(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"role": "admin", "user": "gopher",
+	})
+
+	err := store.UpdateValues(context.Background(), "session-key", session.ID,
+		func(values map[interface{}]interface{}) error {
+			delete(values, "role")
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("Error updating values: %v", err)
+	}
+	values, _ := store.FindValues(context.Background(), "session-key", session.ID)
+	if _, ok := values["role"]; ok || values["user"] != "gopher" {
+		t.Errorf("Expected only the role to be removed; Got %v", values)
+	}
+
+	// A save between the read and the write wins.
+	err = store.UpdateValues(context.Background(), "session-key", session.ID,
+		func(values map[interface{}]interface{}) error {
+			store.Now = func() time.Time { return time.Now().Add(time.Second) }
+			defer func() { store.Now = time.Now }()
+			req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+			return store.Save(req, httptest.NewRecorder(), session)
+		})
+	if err != ErrConcurrentModification {
+		t.Errorf("Expected ErrConcurrentModification; Got %v", err)
+	}
+
+	mutateErr := errors.New("no")
+	if err = store.UpdateValues(context.Background(), "session-key", session.ID,
+		func(map[interface{}]interface{}) error { return mutateErr }); err != mutateErr {
+		t.Errorf("Expected the mutate error; Got %v", err)
+	}
+	if err = store.UpdateValues(context.Background(), "session-key",
+		primitive.NewObjectID().Hex(),
+		func(map[interface{}]interface{}) error { return nil }); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+}
+
+func TestMongoStoreStats(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	stats, err := store.Stats(context.Background())
+	if err != nil || stats != (StoreStats{}) {
+		t.Fatalf("Expected empty stats; Got %+v, %v", stats, err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	saveTestSessionAt(t, store, now.Add(-time.Hour), nil)
+	saveTestSessionAt(t, store, now, nil)
+	list, _ := store.List(context.Background(), 0, 0)
+
+	stats, err = store.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if stats.Sessions != 2 || !stats.Oldest.Equal(now.Add(-time.Hour)) ||
+		!stats.Newest.Equal(now) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if want := int64(len(list[0].Data) + len(list[1].Data)); stats.ApproxDataBytes != want {
+		t.Errorf("Expected %d data bytes; Got %d", want, stats.ApproxDataBytes)
+	}
+}
+
+func TestMongoStoreSaveField(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.RawValues = true
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"profile": strings.Repeat("stable ", 100), "hits": 1, "user_id": "u1",
+	})
+	before := findTestSession(t, coll, session.ID)
+
+	ctx := context.Background()
+	if err := store.SaveField(ctx, session.ID, "hits", 2); err != nil {
+		t.Fatalf("Error saving field: %v", err)
+	}
+	if err := store.SaveField(ctx, session.ID, "user_id", "u2"); err != nil {
+		t.Fatalf("Error saving field: %v", err)
+	}
+	after := findTestSession(t, coll, session.ID)
+	if after.Values["hits"] != int32(2) {
+		t.Errorf("Expected hits 2; Got %v (%T)", after.Values["hits"],
+			after.Values["hits"])
+	}
+	if after.Values["profile"] != before.Values["profile"] {
+		t.Errorf("Expected profile untouched; Got %v", after.Values["profile"])
+	}
+	if after.UserID != "u2" {
+		t.Errorf("Expected user_id u2; Got %q", after.UserID)
+	}
+	if !after.Modified.Equal(before.Modified) {
+		t.Errorf("Expected modified %v unchanged; Got %v", before.Modified,
+			after.Modified)
+	}
+
+	for _, key := range []string{"", "a.b", "$set"} {
+		if err := store.SaveField(ctx, session.ID, key, 1); err == nil {
+			t.Errorf("Expected an error for key %q", key)
+		}
+	}
+	if err := store.SaveField(ctx, primitive.NewObjectID().Hex(), "hits",
+		1); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+	store.RawValues = false
+	if err := store.SaveField(ctx, session.ID, "hits", 3); err == nil {
+		t.Errorf("Expected an error without RawValues")
+	}
+}
+
+func TestMongoStorePopFlashes(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.RawValues = true
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, err := store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["user"] = "gopher"
+	session.AddFlash("saved")
+	session.AddFlash("welcome back")
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	ctx := context.Background()
+	flashes, err := store.PopFlashes(ctx, session)
+	if err != nil {
+		t.Fatalf("Error popping flashes: %v", err)
+	}
+	if !reflect.DeepEqual(flashes, []interface{}{"saved", "welcome back"}) {
+		t.Errorf("Expected both flashes; Got %v", flashes)
+	}
+	if _, ok := session.Values["_flash"]; ok {
+		t.Errorf("Expected the flashes removed from the session")
+	}
+	s := findTestSession(t, coll, session.ID)
+	if _, ok := s.Values["_flash"]; ok || s.Values["user"] != "gopher" {
+		t.Errorf("Expected only the flashes cleared; Got %v", s.Values)
+	}
+
+	if flashes, err = store.PopFlashes(ctx, session); err != nil || flashes != nil {
+		t.Errorf("Expected no flashes; Got %v, %v", flashes, err)
+	}
+	session.ID = primitive.NewObjectID().Hex()
+	if _, err = store.PopFlashes(ctx, session); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+
+	store.SoftDelete = true
+	deleted, _ := saveTestSession(t, store, nil)
+	if err = store.DeleteByID(ctx, deleted.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if _, err = store.PopFlashes(ctx, deleted); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound for a tombstone; Got %v", err)
+	}
+}
+
+func TestMongoStoreIncrement(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.RawValues = true
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher", "hits": 1,
+	})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Increment(ctx, session.ID, "hits", 2); err != nil {
+				t.Errorf("Error incrementing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	total, err := store.Increment(ctx, session.ID, "hits", 0)
+	if err != nil || total != 21 {
+		t.Errorf("Expected 21 hits; Got %d, %v", total, err)
+	}
+	if total, err = store.Increment(ctx, session.ID, "new", -1); err != nil ||
+		total != -1 {
+		t.Errorf("Expected a missing value to start at zero; Got %d, %v",
+			total, err)
+	}
+	if s := findTestSession(t, coll, session.ID); s.Values["user"] != "gopher" {
+		t.Errorf("Expected other values untouched; Got %v", s.Values)
+	}
+
+	if _, err = store.Increment(ctx, session.ID, "user", 1); err == nil {
+		t.Errorf("Expected an error incrementing a string")
+	}
+	if _, err = store.Increment(ctx, primitive.NewObjectID().Hex(), "hits",
+		1); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+
+	store.SoftDelete = true
+	if err = store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if _, err = store.Increment(ctx, session.ID, "hits",
+		1); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound for a tombstone; Got %v", err)
+	}
+}
+
+func TestMongoStoreSoftDeleteReads(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.SoftDelete = true
+	store.IndexedFields = []string{"tenant_id"}
+	values := map[interface{}]interface{}{"user_id": "alice", "tenant_id": "t1"}
+	live, _ := saveTestSession(t, store, values)
+	deleted, _ := saveTestSession(t, store, values)
+
+	ctx := context.Background()
+	if err := store.DeleteByID(ctx, deleted.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	if n, err := store.Count(ctx); n != 1 || err != nil {
+		t.Errorf("Expected 1 live session; Got %d, %v", n, err)
+	}
+	if n, err := store.CountWhere(ctx, bson.M{
+		"deleted_at": bson.M{"$exists": true},
+	}); n != 1 || err != nil {
+		t.Errorf("Expected to count 1 tombstone; Got %d, %v", n, err)
+	}
+	if list, err := store.List(ctx, 0, 0); err != nil || len(list) != 1 ||
+		list[0].ID != live.ID {
+		t.Errorf("Expected only %s listed; Got %v, %v", live.ID, list, err)
+	}
+	if list, err := store.FindByField(ctx, "tenant_id", "t1"); err != nil ||
+		len(list) != 1 {
+		t.Errorf("Expected 1 session found; Got %d, %v", len(list), err)
+	}
+	if ids, err := store.IDsByField(ctx, "tenant_id", "t1"); err != nil ||
+		!reflect.DeepEqual(ids, []string{live.ID}) {
+		t.Errorf("Expected [%s]; Got %v, %v", live.ID, ids, err)
+	}
+	if infos, err := store.InfoByUserID(ctx, "alice"); err != nil ||
+		len(infos) != 1 || infos[0].ID != live.ID {
+		t.Errorf("Expected only %s to be active; Got %v, %v", live.ID, infos,
+			err)
+	}
+
+	if _, err := store.IsExpired(ctx, deleted.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from IsExpired; Got %v", err)
+	}
+	if _, err := store.FindValues(ctx, "session-key",
+		deleted.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from FindValues; Got %v", err)
+	}
+	if _, err := store.Export(ctx, "session-key",
+		deleted.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from Export; Got %v", err)
+	}
+	if _, err := store.FindValues(ctx, "session-key", live.ID); err != nil {
+		t.Errorf("Expected the live session's values; Got %v", err)
+	}
+	if ok, err := store.Exists(ctx, deleted.ID); ok || err != nil {
+		t.Errorf("Expected the tombstone not to exist; Got %v, %v", ok, err)
+	}
+	if s, err := store.FindSession(ctx, deleted.ID); err != nil ||
+		s.DeletedAt.IsZero() {
+		t.Errorf("Expected FindSession to return the tombstone; Got %v", err)
+	}
+}
+
+func TestMongoStoreSoftDeleteWrites(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.SoftDelete = true
+	store.RawValues = true
+	store.OptimisticLocking = true
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"n": 1,
+	})
+
+	ctx := context.Background()
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	before := findTestSession(t, coll, session.ID)
+
+	if err := store.Touch(ctx, session); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from Touch; Got %v", err)
+	}
+	if err := store.SaveField(ctx, session.ID, "n", 2); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from SaveField; Got %v", err)
+	}
+	err := store.UpdateValues(ctx, "session-key", session.ID,
+		func(values map[interface{}]interface{}) error {
+			values["n"] = 3
+			return nil
+		})
+	if err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from UpdateValues; Got %v", err)
+	}
+	// A save with the version loaded before the logout finds it gone.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err = store.Save(req, httptest.NewRecorder(),
+		session); err != ErrConcurrentModification {
+		t.Errorf("Expected ErrConcurrentModification from Save; Got %v", err)
+	}
+
+	after := findTestSession(t, coll, session.ID)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected the tombstone to be left alone; Got %+v, want %+v",
+			after, before)
+	}
+}
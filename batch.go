@@ -0,0 +1,86 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BatchError is returned by SaveBatch when some sessions could not be saved.
+// The sessions not listed were written.
+type BatchError struct {
+	// Errors maps the ID of each failed session to its error.
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for id, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", id, err))
+	}
+	return fmt.Sprintf("mongo-store: %d sessions not saved: %s", len(e.Errors),
+		strings.Join(msgs, "; "))
+}
+
+// SaveBatch upserts list in a single unordered bulk write, assigning an ID
+// to sessions that have none. A session that fails to encode or write does
+// not stop the others; the failures are reported in a *BatchError. Unlike
+// Save, no tokens are set and sessions with a negative MaxAge are written
+// like any other.
+func (m *MongoStore) SaveBatch(ctx context.Context,
+	list []*sessions.Session) error {
+	failed := map[string]error{}
+	var ids []string
+	var models []mongo.WriteModel
+	for _, session := range list {
+		if session.ID == "" {
+			session.ID = m.newID()
+		}
+		key, err := m.parseID(session.ID)
+		if err != nil {
+			failed[session.ID] = err
+			continue
+		}
+		s, err := m.document(ctx, session)
+		if err != nil {
+			failed[session.ID] = err
+			continue
+		}
+		ids = append(ids, session.ID)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(m.upsertFilter(key)).
+			SetUpdate(m.update(s)).
+			SetUpsert(true))
+	}
+
+	if len(models) > 0 {
+		coll, err := m.concernCollection(nil)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		_, err = coll.BulkWrite(ctx, models,
+			mongoOpts.BulkWrite().SetOrdered(false))
+		m.uncache(ids...)
+		var bulkErr mongo.BulkWriteException
+		switch {
+		case errors.As(err, &bulkErr):
+			for _, we := range bulkErr.WriteErrors {
+				failed[ids[we.Index]] = we
+			}
+		case err != nil:
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
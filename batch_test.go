@@ -0,0 +1,46 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMongoStoreSaveBatch(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.RespectModifiedValue = true
+
+	var list []*sessions.Session
+	for i := 0; i < 3; i++ {
+		session := sessions.NewSession(store, "session-key")
+		session.Values["n"] = i
+		list = append(list, session)
+	}
+	list[1].Values["modified"] = "yesterday"
+
+	err := store.SaveBatch(context.Background(), list)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a BatchError; Got %v", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Errors[list[1].ID] == nil {
+		t.Errorf("Expected only %s to fail; Got %v", list[1].ID, batchErr)
+	}
+
+	for _, i := range []int{0, 2} {
+		values, err := store.FindValues(context.Background(), "session-key",
+			list[i].ID)
+		if err != nil {
+			t.Fatalf("Error finding session %d: %v", i, err)
+		}
+		if values["n"] != i {
+			t.Errorf("Expected %d; Got %v", i, values["n"])
+		}
+	}
+	if n, _ := store.Count(context.Background()); n != 2 {
+		t.Errorf("Expected 2 sessions; Got %d", n)
+	}
+}
@@ -0,0 +1,177 @@
+package mongostore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultCacheTTL is how long a session stays in the Cache when CacheTTL is
+// not set.
+const defaultCacheTTL = 5 * time.Second
+
+// Cache holds stored sessions in front of MongoDB so that repeated loads of
+// the same session within a burst of requests skip the database. Entries are
+// keyed by session ID, after the Namespace if there is one, and hold the
+// stored document in BSON. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the entry for id, if there is one that has not expired.
+	Get(id string) ([]byte, bool)
+	// Set stores data for id for at most ttl.
+	Set(id string, data []byte, ttl time.Duration)
+	// Delete removes the entry for id, if any.
+	Delete(id string)
+}
+
+// cached returns the stored session id from Cache, or nil on a miss.
+func (m *MongoStore) cached(id string) *Session {
+	if m.Cache == nil {
+		return nil
+	}
+	data, ok := m.Cache.Get(m.cacheKey(id))
+	if !ok {
+		return nil
+	}
+	s := &Session{}
+	if err := bson.Unmarshal(data, s); err != nil {
+		m.Cache.Delete(m.cacheKey(id))
+		return nil
+	}
+	return s
+}
+
+// cacheKey returns the Cache key of the session id, prefixed with the
+// database, collection and Namespace so stores sharing a Cache, such as
+// those returned by WithCollection, stay apart.
+func (m *MongoStore) cacheKey(id string) string {
+	prefix := m.coll.GetCollectionName()
+	if c, err := m.coll.CloneCollection(); err == nil {
+		prefix = c.Database().Name() + "." + c.Name()
+	}
+	if m.Namespace != "" {
+		prefix += "/" + m.Namespace
+	}
+	return prefix + "/" + id
+}
+
+// cache puts the stored session s in Cache for CacheTTL, or until it
+// expires if that is sooner.
+func (m *MongoStore) cache(s *Session) {
+	if m.Cache == nil {
+		return
+	}
+	ttl := m.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if !s.ExpiresAt.IsZero() {
+		if left := s.ExpiresAt.Sub(m.now()); left < ttl {
+			ttl = left
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	data, err := bson.Marshal(s)
+	if err != nil {
+		return
+	}
+	m.Cache.Set(m.cacheKey(s.ID), data, ttl)
+}
+
+// uncache removes the sessions ids from Cache after they were written or
+// deleted.
+func (m *MongoStore) uncache(ids ...string) {
+	if m.Cache == nil {
+		return
+	}
+	for _, id := range ids {
+		m.Cache.Delete(m.cacheKey(id))
+	}
+}
+
+// LRUCache is an in-process Cache holding at most a fixed number of
+// sessions, evicting the least recently used one to make room.
+type LRUCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	id      string
+	data    []byte
+	expires time.Time
+}
+
+// NewLRUCache returns an LRUCache holding at most size sessions, and at
+// least one.
+func NewLRUCache(size int) *LRUCache {
+	if size < 1 {
+		size = 1
+	}
+	return &LRUCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry for id and marks it as recently used.
+func (c *LRUCache) Get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.data, true
+}
+
+// Set stores data for id for ttl, evicting the least recently used entry if
+// the cache is full.
+func (c *LRUCache) Set(id string, data []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &lruEntry{id: id, data: data, expires: time.Now().Add(ttl)}
+	if el, ok := c.items[id]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[id] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete removes the entry for id.
+func (c *LRUCache) Delete(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet
+// evicted.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).id)
+}
@@ -0,0 +1,160 @@
+package mongostore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2)
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	// b is now the least recently used.
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if data, ok := c.Get("a"); !ok || string(data) != "1" {
+		t.Errorf("Expected a to be kept; Got %q, %v", data, ok)
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Expected a to be deleted")
+	}
+	c.Set("d", []byte("4"), -time.Second)
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("Expected an expired entry to be missed")
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("Expected 1 entry; Got %d", n)
+	}
+}
+
+func TestMongoStoreCache(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.Cache = NewLRUCache(10)
+	store.CacheTTL = time.Minute
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	load := func() (string, bool) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Add("Cookie", cookie)
+		loaded, err := store.New(req, "session-key")
+		if err != nil && !loaded.IsNew {
+			t.Fatalf("Error loading session: %v", err)
+		}
+		user, _ := loaded.Values["user"].(string)
+		return user, loaded.IsNew
+	}
+
+	if user, _ := load(); user != "gopher" {
+		t.Fatalf("Expected gopher; Got %q", user)
+	}
+	// A write behind the store's back is not seen while cached.
+	oID, _ := primitive.ObjectIDFromHex(session.ID)
+	if err := coll.UpdateOne(context.Background(), bson.M{"_id": oID},
+		bson.M{"$set": bson.M{"data": "garbage"}}); err != nil {
+		t.Fatalf("Error updating session: %v", err)
+	}
+	if user, _ := load(); user != "gopher" {
+		t.Errorf("Expected the cached session; Got %q", user)
+	}
+
+	// Logging out removes the session from the cache.
+	session.Options.MaxAge = -1
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if _, isNew := load(); !isNew {
+		t.Errorf("Expected a deleted session not to be served from the cache")
+	}
+}
+
+func TestMongoStoreCacheSoftDelete(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.Cache = NewLRUCache(10)
+	store.CacheTTL = time.Minute
+	store.SoftDelete = true
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if _, err := store.New(req, "session-key"); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+
+	if err := store.DeleteByID(context.Background(), session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if loaded, _ := store.New(req, "session-key"); !loaded.IsNew {
+		t.Errorf("Expected a tombstone not to be served from the cache")
+	}
+}
+
+func TestMongoStoreCacheCollections(t *testing.T) {
+	storeA := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	storeA.Cache = NewLRUCache(10)
+	storeA.CacheTTL = time.Minute
+	storeB := storeA.WithCollection(newTestCollection(t))
+
+	_, cookie := saveTestSession(t, storeA, map[interface{}]interface{}{
+		"tenant": "A",
+	})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if _, err := storeA.New(req, "session-key"); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+
+	// The same token must not load A's cached session from B's collection.
+	if loaded, _ := storeB.New(req, "session-key"); !loaded.IsNew ||
+		len(loaded.Values) != 0 {
+		t.Errorf("Expected B not to see A's session; Got %v", loaded.Values)
+	}
+	if loaded, err := storeA.New(req, "session-key"); err != nil ||
+		loaded.Values["tenant"] != "A" {
+		t.Errorf("Expected A's session; Got %v, %v", loaded.Values, err)
+	}
+}
+
+func TestMongoStoreCacheSaveBatch(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.Cache = NewLRUCache(10)
+	store.CacheTTL = time.Minute
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if _, err := store.New(req, "session-key"); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+
+	session.Values["user"] = "alice"
+	if err := store.SaveBatch(context.Background(),
+		[]*sessions.Session{session}); err != nil {
+		t.Fatalf("Error saving batch: %v", err)
+	}
+	loaded, err := store.New(req, "session-key")
+	if err != nil || loaded.Values["user"] != "alice" {
+		t.Errorf("Expected the batch write, not the cached session; Got %v, %v",
+			loaded.Values["user"], err)
+	}
+}
@@ -0,0 +1,60 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errNamespaceExists is the server error code for creating a collection that
+// already exists.
+const errNamespaceExists = 48
+
+// capped reports whether the store backs onto a capped collection.
+func (m *MongoStore) capped() bool {
+	return m.CappedSize > 0
+}
+
+// ensureCapped creates the collection as capped with CappedSize and
+// CappedMax. An existing collection, capped or not, is left as it is.
+func (m *MongoStore) ensureCapped(ctx context.Context) error {
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return err
+	}
+	opts := mongoOpts.CreateCollection().SetCapped(true).
+		SetSizeInBytes(m.CappedSize)
+	if m.CappedMax > 0 {
+		opts.SetMaxDocuments(m.CappedMax)
+	}
+	err = c.Database().CreateCollection(ctx, c.Name(), opts)
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(errNamespaceExists) {
+		return nil
+	}
+	return err
+}
+
+// expireCapped marks the document under key as expired instead of removing
+// it, as documents cannot be deleted from a capped collection. load then
+// treats it as gone.
+func (m *MongoStore) expireCapped(ctx context.Context, key interface{}) error {
+	c, err := m.concernCollection(nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.UpdateOne(ctx, m.idFilter(key), bson.M{
+		"$set": bson.M{"expires_at": time.Unix(0, 0)},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
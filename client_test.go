@@ -0,0 +1,73 @@
+package mongostore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMongoStoreClientIP(t *testing.T) {
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+	store.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"198.51.100.7:1234", "", "198.51.100.7"},
+		{"198.51.100.7:1234", "203.0.113.9", "198.51.100.7"},
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.9"},
+		{"10.1.2.3:1234", "6.6.6.6, 203.0.113.9, 192.0.2.1", "203.0.113.9"},
+		{"10.1.2.3:1234", "10.4.4.4", "10.4.4.4"},
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := store.clientIP(req); got != tt.want {
+			t.Errorf("%s via %q: Expected %s; Got %s", tt.remote, tt.forwarded,
+				tt.want, got)
+		}
+	}
+}
+
+func TestMongoStoreRecordClient(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+
+	save := func() string {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		req.Header.Set("User-Agent", "gopher/1.0")
+		session, _ := store.New(req, "session-key")
+		session.Values["user_id"] = "alice"
+		if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+			t.Fatalf("Error saving session: %v", err)
+		}
+		return session.ID
+	}
+
+	if s := findTestSession(t, coll, save()); s.IP != "" || s.UserAgent != "" {
+		t.Errorf("Expected no client without RecordClient; Got %+v", s)
+	}
+
+	store.RecordClient = true
+	id := save()
+	if s := findTestSession(t, coll, id); s.IP != "198.51.100.7" ||
+		s.UserAgent != "gopher/1.0" {
+		t.Errorf("Expected the client to be recorded; Got %q, %q", s.IP,
+			s.UserAgent)
+	}
+	list, err := store.InfoByUserID(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("Error listing sessions: %v", err)
+	}
+	for _, info := range list {
+		if info.ID == id && info.IP != "198.51.100.7" {
+			t.Errorf("Expected the IP in the session info; Got %+v", info)
+		}
+	}
+}
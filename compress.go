@@ -0,0 +1,49 @@
+package mongostore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compress gzips data.
+func compress(data []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	zw := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(zw)
+	zw.Reset(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return detach(buf), nil
+}
+
+// decompress reverses compress.
+func decompress(data []byte) ([]byte, error) {
+	src := bytes.NewReader(data)
+	zr, ok := gunzipPool.Get().(*gzip.Reader)
+	if ok {
+		if err := zr.Reset(src); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if zr, err = gzip.NewReader(src); err != nil {
+			return nil, err
+		}
+	}
+	defer gunzipPool.Put(zr)
+	defer zr.Close()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, err
+	}
+	return detach(buf), nil
+}
@@ -0,0 +1,137 @@
+package mongostore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// concernCollection returns the underlying driver collection with the
+// store's WriteConcern and ReadConcern, and pref if not nil, applied. qmgo
+// only takes these per database, so operations needing them go through the
+// driver directly.
+func (m *MongoStore) concernCollection(pref *readpref.ReadPref) (
+	*mongo.Collection, error) {
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return nil, err
+	}
+	opts := mongoOpts.Collection()
+	if m.WriteConcern != nil {
+		opts.SetWriteConcern(m.WriteConcern)
+	}
+	if m.ReadConcern != nil {
+		opts.SetReadConcern(m.ReadConcern)
+	}
+	if pref != nil {
+		opts.SetReadPreference(pref)
+	}
+	return c.Clone(opts)
+}
+
+// writeCollection returns the driver collection for the writes of Save and
+// the deletes of logout and DeleteByID: with the store's WriteConcern, or
+// unacknowledged with Unacknowledged.
+func (m *MongoStore) writeCollection() (*mongo.Collection, error) {
+	if !m.Unacknowledged {
+		return m.concernCollection(nil)
+	}
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return nil, err
+	}
+	return c.Clone(mongoOpts.Collection().
+		SetWriteConcern(writeconcern.New(writeconcern.W(0))))
+}
+
+// writeConcerned upserts update under key with the store's WriteConcern.
+func (m *MongoStore) writeConcerned(ctx context.Context, key interface{},
+	update bson.M) error {
+	c, err := m.writeCollection()
+	if err != nil {
+		return err
+	}
+	_, err = c.UpdateOne(ctx, m.upsertFilter(key), update,
+		mongoOpts.Update().SetUpsert(true))
+	if err == mongo.ErrUnacknowledgedWrite {
+		return nil
+	}
+	return err
+}
+
+// writeGuarded writes update over the document under key only if it also
+// matches guard, returning ErrConcurrentModification if another writer
+// changed it and ErrSessionNotFound if it is gone or a SoftDelete tombstone.
+func (m *MongoStore) writeGuarded(ctx context.Context, key interface{},
+	guard bson.M, update bson.M) error {
+	c, err := m.concernCollection(nil)
+	if err != nil {
+		return err
+	}
+	filter := m.liveIDFilter(key)
+	for k, v := range guard {
+		filter[k] = v
+	}
+	res, err := c.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	n, err := c.CountDocuments(ctx, m.liveIDFilter(key))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return ErrConcurrentModification
+}
+
+// removeConcerned deletes the document under key with the store's
+// WriteConcern, returning ErrSessionNotFound if there was none. An
+// unacknowledged delete cannot tell and returns nil.
+func (m *MongoStore) removeConcerned(ctx context.Context,
+	key interface{}) error {
+	c, err := m.writeCollection()
+	if err != nil {
+		return err
+	}
+	res, err := c.DeleteOne(ctx, m.idFilter(key))
+	if err == mongo.ErrUnacknowledgedWrite {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// findConcerned reads the raw document under key with the store's
+// ReadConcern and the read preference pref, returning ErrSessionNotFound if
+// there is none.
+func (m *MongoStore) findConcerned(ctx context.Context, key interface{},
+	projection bson.M, pref *readpref.ReadPref) (bson.M, error) {
+	c, err := m.concernCollection(pref)
+	if err != nil {
+		return nil, err
+	}
+	opts := mongoOpts.FindOne()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	var raw bson.M
+	err = c.FindOne(ctx, m.idFilter(key), opts).Decode(&raw)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	return raw, err
+}
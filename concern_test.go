@@ -0,0 +1,100 @@
+package mongostore
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/p000ic/go-mongo-store/mongostoretest"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+func TestMongoStoreConcerns(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.WriteConcern = writeconcern.New(writeconcern.W(1))
+	store.ReadConcern = readconcern.Local()
+	store.ReadPreference = readpref.SecondaryPreferred()
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	loaded, err := store.New(req, "session-key")
+	if err != nil || loaded.IsNew {
+		t.Fatalf("Expected the saved session; Got %v", err)
+	}
+	if loaded.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", loaded.Values["user"])
+	}
+
+	if err = store.DeleteByID(context.Background(), session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if err = store.DeleteByID(context.Background(), session.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+	if _, err = store.FindSession(context.Background(),
+		primitive.NewObjectID().Hex()); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+}
+
+func TestMongoStoreUnacknowledged(t *testing.T) {
+	coll := newTestCollection(t)
+	// Unacknowledged writes leave replies unread on the connection, so use
+	// a client of its own.
+	ctx := context.Background()
+	_, own := mongostoretest.Reconnect(t, coll)
+	store := MustNewMongoStore(own, 3600, false, testHashKey)
+	store.Unacknowledged = true
+
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{"n": 1})
+	waitFor := func(want int64) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if n, _ := coll.Find(ctx, bson.M{}).Count(); n == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d sessions to be stored eventually", want)
+	}
+	waitFor(1)
+
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	waitFor(0)
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Errorf("Expected no error for an unacknowledged delete; Got %v", err)
+	}
+
+	store.SoftDelete = true
+	session, _ = saveTestSession(t, store, nil)
+	waitFor(1)
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatalf("Error soft-deleting session: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if n, _ := coll.Find(ctx, bson.M{
+			"deleted_at": bson.M{"$exists": true},
+		}).Count(); n == 1 {
+			break
+		}
+		if i == 49 {
+			t.Fatal("Expected the tombstone to be stored eventually")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Errorf("Expected no error for an unacknowledged soft delete; Got %v",
+			err)
+	}
+}
@@ -0,0 +1,68 @@
+package mongostore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypter encrypts serialized session values before they are stored and
+// decrypts them after they are read, independently of the securecookie
+// codecs. Assign one to MongoStore.Encrypter.
+type Encrypter interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// AESGCMEncrypter is an Encrypter using AES in GCM mode. Each ciphertext
+// starts with its random nonce and is authenticated, so tampering is
+// detected on Decrypt.
+type AESGCMEncrypter struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMEncrypter returns an AESGCMEncrypter for key, which must be 16,
+// 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+func NewAESGCMEncrypter(key []byte) (*AESGCMEncrypter, error) {
+	switch n := len(key); n {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("%w: AES key is %d bytes, want 16, 24 or 32",
+			ErrWeakKey, n)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMEncrypter{aead: aead}, nil
+}
+
+// Encrypt seals plaintext under a fresh random nonce.
+func (e *AESGCMEncrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt.
+func (e *AESGCMEncrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("mongo-store: ciphertext too short")
+	}
+	plaintext, err := e.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("mongo-store: failed to decrypt session: %w",
+			err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,69 @@
+package mongostore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAESGCMEncrypter(t *testing.T) {
+	e, err := NewAESGCMEncrypter(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatalf("Error creating encrypter: %v", err)
+	}
+
+	plaintext := []byte("session values")
+	ciphertext, err := e.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Errorf("Expected the plaintext to be hidden")
+	}
+	got, err := e.Decrypt(ciphertext)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Expected %q; Got %q, %v", plaintext, got, err)
+	}
+
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err = e.Decrypt(ciphertext); err == nil {
+		t.Errorf("Expected a tampered ciphertext to fail")
+	}
+	if _, err = e.Decrypt([]byte("short")); err == nil {
+		t.Errorf("Expected a truncated ciphertext to fail")
+	}
+
+	if _, err = NewAESGCMEncrypter([]byte("short")); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("Expected ErrWeakKey; Got %v", err)
+	}
+}
+
+func TestMongoStoreEncrypter(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.Encrypter, _ = NewAESGCMEncrypter(bytes.Repeat([]byte("k"), 32))
+
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	if s := findTestSession(t, coll, session.ID); !s.Encrypted {
+		t.Errorf("Expected the stored document to be marked encrypted")
+	}
+
+	values, err := store.FindValues(context.Background(), "session-key", session.ID)
+	if err != nil || values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v, %v", values["user"], err)
+	}
+
+	store.Encrypter, _ = NewAESGCMEncrypter(bytes.Repeat([]byte("x"), 32))
+	if _, err = store.FindValues(context.Background(), "session-key",
+		session.ID); err == nil {
+		t.Errorf("Expected decryption with another key to fail")
+	}
+	store.Encrypter = nil
+	if _, err = store.FindValues(context.Background(), "session-key",
+		session.ID); err == nil {
+		t.Errorf("Expected loading without an Encrypter to fail")
+	}
+}
@@ -0,0 +1,29 @@
+package mongostore
+
+import (
+	"errors"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IsNotFound reports whether err, as returned by the store, means that no
+// session is stored under the ID.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrSessionNotFound) ||
+		errors.Is(err, qmgo.ErrNoSuchDocuments) ||
+		errors.Is(err, mongo.ErrNoDocuments)
+}
+
+// IsDuplicateKey reports whether err, as returned by the store, is MongoDB
+// rejecting a write that would duplicate a unique key, such as an
+// IDGenerator handing out an ID already in use.
+func IsDuplicateKey(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// IsNetworkError reports whether err, as returned by the store, is a failure
+// to reach MongoDB, which is often worth retrying.
+func IsNetworkError(err error) bool {
+	return mongo.IsNetworkError(err)
+}
@@ -0,0 +1,42 @@
+package mongostore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestErrorClassification(t *testing.T) {
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{
+		{Code: 11000, Message: "E11000 duplicate key error"},
+	}}
+	network := mongo.CommandError{Message: "connection reset",
+		Labels: []string{"NetworkError"}}
+
+	tests := []struct {
+		err                            error
+		notFound, duplicate, isNetwork bool
+	}{
+		{ErrSessionNotFound, true, false, false},
+		{fmt.Errorf("loading: %w", qmgo.ErrNoSuchDocuments), true, false, false},
+		{mongo.ErrNoDocuments, true, false, false},
+		{fmt.Errorf("saving: %w", duplicate), false, true, false},
+		{&kindError{kind: ErrStore, err: network}, false, false, true},
+		{errors.New("other"), false, false, false},
+		{nil, false, false, false},
+	}
+	for _, tt := range tests {
+		if got := IsNotFound(tt.err); got != tt.notFound {
+			t.Errorf("IsNotFound(%v): Expected %v", tt.err, tt.notFound)
+		}
+		if got := IsDuplicateKey(tt.err); got != tt.duplicate {
+			t.Errorf("IsDuplicateKey(%v): Expected %v", tt.err, tt.duplicate)
+		}
+		if got := IsNetworkError(tt.err); got != tt.isNetwork {
+			t.Errorf("IsNetworkError(%v): Expected %v", tt.err, tt.isNetwork)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package mongostore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	mongostore "github.com/p000ic/go-mongo-store"
+)
+
+// QueryToken reads the session token from a query parameter named after the
+// session. Tokens cannot be written back into the URL, so SetToken leaves it
+// to the application to hand the value to the client.
+type QueryToken struct {
+	Issued map[string]string
+}
+
+func (q *QueryToken) GetToken(req *http.Request, name string) (string, error) {
+	token := req.URL.Query().Get(name)
+	if token == "" {
+		return "", errors.New("no token in query")
+	}
+	return token, nil
+}
+
+func (q *QueryToken) SetToken(rw http.ResponseWriter, name, value string,
+	options *sessions.Options) {
+	q.Issued[name] = value
+}
+
+func ExampleTokenGetSeter() {
+	var token mongostore.TokenGetSeter = &QueryToken{
+		Issued: make(map[string]string),
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/?session-key=abc", nil)
+	// Use it with a store by assigning store.Token = token.
+	value, err := token.GetToken(req, "session-key")
+	fmt.Println(value, err)
+	// Output: abc <nil>
+}
+
+// legacySession is a session read from the store being migrated from.
+type legacySession struct {
+	ID       string
+	Values   map[interface{}]interface{}
+	Modified time.Time
+}
+
+func ExampleMongoStore_Import() {
+	var store *mongostore.MongoStore // from mongostore.NewMongoStore
+	var legacy []legacySession       // read from the old store
+
+	for _, s := range legacy {
+		err := store.Import(context.Background(), "session-key", s.ID,
+			s.Values, s.Modified)
+		if err != nil {
+			log.Printf("importing session %s: %v", s.ID, err)
+		}
+	}
+}
+
+// tenantKey is the context key under which middleware stores the tenant of
+// the request.
+type tenantKey struct{}
+
+func ExampleHKDFKeyDeriver() {
+	var store *mongostore.MongoStore // from mongostore.NewMongoStore
+	master := []byte("a secret of at least 32 random bytes")
+
+	// Each tenant's sessions are encrypted with keys derived from the tenant
+	// ID taken from the request context.
+	store.KeyDeriver = &mongostore.HKDFKeyDeriver{
+		Master: master,
+		Info: func(ctx context.Context, session *sessions.Session) (string,
+			error) {
+			tenant, ok := ctx.Value(tenantKey{}).(string)
+			if !ok {
+				return "", errors.New("request has no tenant")
+			}
+			return tenant, nil
+		},
+	}
+}
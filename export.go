@@ -0,0 +1,155 @@
+package mongostore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// exportedSession is the JSON form of a session written by Export.
+type exportedSession struct {
+	Name     string                   `json:"name"`
+	ID       string                   `json:"id"`
+	Created  time.Time                `json:"created"`
+	Modified time.Time                `json:"modified"`
+	Values   map[string]exportedValue `json:"values"`
+}
+
+// exportedValue is a session value tagged with the kind of Go value it was,
+// so ImportJSON can restore it.
+type exportedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Export returns the session stored under the ID id as a JSON document with
+// its decoded values and timestamps, for support tooling. name is the session
+// name it was saved with, which the codecs need. Pass the document to
+// ImportJSON to recreate the session.
+//
+// Strings, booleans, integers, floats, time.Time and []byte are tagged with
+// their kind and restored as string, bool, int, float64, time.Time and []byte,
+// so sized types such as int32 come back as int. Any other value is exported
+// as plain JSON and comes back as what encoding/json decodes it to, such as
+// map[string]interface{} for a struct; values encoding/json cannot encode
+// fail the export. Values under keys that are not strings cannot be exported.
+func (m *MongoStore) Export(ctx context.Context, name, id string) ([]byte,
+	error) {
+	s, err := m.findLiveID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	session := sessions.NewSession(m, name)
+	session.ID = id
+	if err = m.decode(ctx, s, session); err != nil {
+		return nil, err
+	}
+	values := session.Values
+
+	out := exportedSession{
+		Name:     name,
+		ID:       id,
+		Created:  s.Created,
+		Modified: s.Modified,
+		Values:   make(map[string]exportedValue, len(values)),
+	}
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("mongo-store: cannot export value under "+
+				"non-string key %v", k)
+		}
+		if out.Values[key], err = exportValue(v); err != nil {
+			return nil, fmt.Errorf("mongo-store: cannot export value %q: %w",
+				key, err)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// exportValue tags v with its kind and encodes it.
+func exportValue(v interface{}) (exportedValue, error) {
+	typ := "json"
+	switch v.(type) {
+	case string:
+		typ = "string"
+	case bool:
+		typ = "bool"
+	case time.Time:
+		typ = "time"
+	case []byte:
+		typ = "bytes"
+	default:
+		switch reflect.ValueOf(v).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+			reflect.Uint32, reflect.Uint64:
+			typ = "int"
+		case reflect.Float32, reflect.Float64:
+			typ = "float"
+		}
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return exportedValue{}, err
+	}
+	return exportedValue{Type: typ, Value: raw}, nil
+}
+
+// importValue restores a value written by exportValue.
+func importValue(e exportedValue) (interface{}, error) {
+	var v interface{}
+	switch e.Type {
+	case "string":
+		v = new(string)
+	case "bool":
+		v = new(bool)
+	case "int":
+		v = new(int)
+	case "float":
+		v = new(float64)
+	case "time":
+		v = new(time.Time)
+	case "bytes":
+		v = new([]byte)
+	case "json":
+		v = new(interface{})
+	default:
+		return nil, fmt.Errorf("unknown type %q", e.Type)
+	}
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(v).Elem().Interface(), nil
+}
+
+// ImportJSON recreates a session from a document written by Export under a
+// newly generated ID, which it returns, as if it had just been saved. The
+// exported session is left alone. See Export for how values are restored.
+func (m *MongoStore) ImportJSON(ctx context.Context, data []byte) (string,
+	error) {
+	var in exportedSession
+	if err := json.Unmarshal(data, &in); err != nil {
+		return "", fmt.Errorf("mongo-store: invalid session export: %w", err)
+	}
+
+	values := make(map[interface{}]interface{}, len(in.Values))
+	for k, e := range in.Values {
+		v, err := importValue(e)
+		if err != nil {
+			return "", fmt.Errorf("mongo-store: invalid session export "+
+				"value %q: %w", k, err)
+		}
+		values[k] = v
+	}
+
+	id := m.newID()
+	if err := m.Import(ctx, in.Name, id, values, time.Time{}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,59 @@
+package mongostore
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMongoStoreExport(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	login := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user":   "gopher",
+		"admin":  true,
+		"visits": int32(7),
+		"score":  1.5,
+		"login":  login,
+		"raw":    []byte{1, 2},
+		"tags":   []string{"a", "b"},
+	})
+
+	data, err := store.Export(context.Background(), "session-key", session.ID)
+	if err != nil {
+		t.Fatalf("Error exporting session: %v", err)
+	}
+	if !json.Valid(data) {
+		t.Fatalf("Expected valid JSON; Got %s", data)
+	}
+
+	id, err := store.ImportJSON(context.Background(), data)
+	if err != nil {
+		t.Fatalf("Error importing session: %v", err)
+	}
+	if id == session.ID {
+		t.Errorf("Expected a new ID")
+	}
+	values, err := store.FindValues(context.Background(), "session-key", id)
+	if err != nil {
+		t.Fatalf("Error finding imported values: %v", err)
+	}
+	want := map[interface{}]interface{}{
+		"user":   "gopher",
+		"admin":  true,
+		"visits": 7,
+		"score":  1.5,
+		"login":  login,
+		"raw":    []byte{1, 2},
+		"tags":   []interface{}{"a", "b"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %v; Got %v", want, values)
+	}
+
+	if _, err = store.ImportJSON(context.Background(), []byte("{")); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
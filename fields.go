@@ -0,0 +1,177 @@
+package mongostore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FieldNames names the stored document fields that hold the session ID,
+// encoded data and modified time. Empty names keep the defaults "_id", "data"
+// and "modified". When ID is not "_id", the session ID is kept in that field
+// and MongoDB assigns the document its own _id; the field should then carry a
+// unique index.
+type FieldNames struct {
+	ID       string
+	Data     string
+	Modified string
+}
+
+// fields returns the store's field names with defaults filled in.
+func (m *MongoStore) fields() FieldNames {
+	f := m.FieldNames
+	if f.ID == "" {
+		f.ID = "_id"
+	}
+	if f.Data == "" {
+		f.Data = "data"
+	}
+	if f.Modified == "" {
+		f.Modified = "modified"
+	}
+	return f
+}
+
+// idFilter matches the document stored under key, as returned by parseID,
+// in the store's Namespace.
+func (m *MongoStore) idFilter(key interface{}) bson.M {
+	return m.scoped(bson.M{m.fields().ID: key})
+}
+
+// upsertFilter is the filter upserts of the session under key write
+// through. It leaves SoftDelete tombstones out, so an upsert onto one fails
+// on the duplicate ID instead of bringing the session back.
+func (m *MongoStore) upsertFilter(key interface{}) bson.M {
+	return m.live(bson.M{m.fields().ID: key})
+}
+
+// liveIDFilter is idFilter for a session that is neither a SoftDelete
+// tombstone nor logged out of a capped collection by expireCapped.
+func (m *MongoStore) liveIDFilter(key interface{}) bson.M {
+	filter := m.live(bson.M{m.fields().ID: key})
+	if m.capped() {
+		filter["expires_at"] = bson.M{"$ne": time.Unix(0, 0)}
+	}
+	return filter
+}
+
+// scoped returns a copy of filter restricted to the store's Namespace, or
+// filter itself if there is none.
+func (m *MongoStore) scoped(filter bson.M) bson.M {
+	if m.Namespace == "" {
+		return filter
+	}
+	scoped := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		scoped[k] = v
+	}
+	scoped["namespace"] = m.Namespace
+	return scoped
+}
+
+// live returns a copy of filter restricted as by scoped and to sessions that
+// are not SoftDelete tombstones, unless filter already selects on deleted_at.
+func (m *MongoStore) live(filter bson.M) bson.M {
+	live := make(bson.M, len(filter)+2)
+	for k, v := range m.scoped(filter) {
+		live[k] = v
+	}
+	if _, ok := live["deleted_at"]; !ok {
+		live["deleted_at"] = bson.M{"$exists": false}
+	}
+	return live
+}
+
+// reservedFields are the stored fields IndexedFields may not use.
+var reservedFields = map[string]bool{
+	"_id": true, "created": true, "compressed": true, "encrypted": true,
+	"plain": true, "user_id": true, "expires_at": true, "accessed": true,
+	"ip": true, "user_agent": true, "version": true, "values": true,
+	"namespace": true, "deleted_at": true,
+}
+
+// indexedFields returns the IndexedFields values of session, checking that
+// each is a string and does not clash with a stored field.
+func (m *MongoStore) indexedFields(session *sessions.Session) (
+	map[string]string, error) {
+	if len(m.IndexedFields) == 0 {
+		return nil, nil
+	}
+	f := m.fields()
+	indexed := make(map[string]string, len(m.IndexedFields))
+	for _, key := range m.IndexedFields {
+		if reservedFields[key] || key == f.ID || key == f.Data ||
+			key == f.Modified {
+			return nil, fmt.Errorf("mongo-store: indexed field %q clashes "+
+				"with a stored field", key)
+		}
+		val, ok := session.Values[key]
+		if !ok {
+			continue
+		}
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("mongo-store: indexed field %q holds %T, "+
+				"want string", key, val)
+		}
+		indexed[key] = str
+	}
+	return indexed, nil
+}
+
+// isIndexedField reports whether field is listed in IndexedFields.
+func (m *MongoStore) isIndexedField(field string) bool {
+	for _, key := range m.IndexedFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// fromStoredAll converts raw stored documents with fromStored.
+func (m *MongoStore) fromStoredAll(raw []bson.M) ([]Session, error) {
+	list := make([]Session, 0, len(raw))
+	for _, r := range raw {
+		s, err := m.fromStored(r)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *s)
+	}
+	return list, nil
+}
+
+// fromStored converts a raw stored document into a Session, renaming the
+// configured fields back to the names used by the Session struct tags.
+func (m *MongoStore) fromStored(raw bson.M) (*Session, error) {
+	f := m.fields()
+	if f.ID != "_id" {
+		delete(raw, "_id")
+	}
+	for from, to := range map[string]string{
+		f.ID:       "_id",
+		f.Data:     "data",
+		f.Modified: "modified",
+	} {
+		if from == to {
+			continue
+		}
+		if v, ok := raw[from]; ok {
+			raw[to] = v
+			delete(raw, from)
+		}
+	}
+
+	b, err := bson.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err = bson.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,75 @@
+package mongostore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyDeriver returns the codecs for the stored payload of a session. ctx is
+// the context of the load or save, which carries the request's values.
+type KeyDeriver interface {
+	Codecs(ctx context.Context, session *sessions.Session) (
+		[]securecookie.Codec, error)
+}
+
+// HKDFKeyDeriver derives a hash key and an AES-256 key for each session
+// from Master with HKDF-SHA256, so sessions with different info, such as a
+// tenant ID, are signed and encrypted with independent keys and one leaked
+// derived key exposes no others.
+type HKDFKeyDeriver struct {
+	// Master is the secret the keys are derived from. It should be at least
+	// 32 random bytes.
+	Master []byte
+	// Info returns what the keys of session are bound to, typically read
+	// from ctx. Sessions with the same info share keys.
+	Info func(ctx context.Context, session *sessions.Session) (string, error)
+}
+
+// Codecs derives the codecs for session.
+func (d *HKDFKeyDeriver) Codecs(ctx context.Context,
+	session *sessions.Session) ([]securecookie.Codec, error) {
+	if n := len(d.Master); n < 32 {
+		return nil, fmt.Errorf("%w: master key is %d bytes, want at least 32",
+			ErrWeakKey, n)
+	}
+	info, err := d.Info(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if info == "" {
+		return nil, errors.New("mongo-store: empty key derivation info")
+	}
+
+	keys := make([]byte, 64)
+	r := hkdf.New(sha256.New, d.Master, nil, []byte(info))
+	if _, err = io.ReadFull(r, keys); err != nil {
+		return nil, err
+	}
+	return securecookie.CodecsFromPairs(keys[:32], keys[32:]), nil
+}
+
+// payloadCodecs returns the codecs for the stored payload of session: from
+// KeyDeriver if set, with the store's MaxAge applied, else the store's.
+func (m *MongoStore) payloadCodecs(ctx context.Context,
+	session *sessions.Session) ([]securecookie.Codec, error) {
+	if m.KeyDeriver == nil {
+		return m.codecs(), nil
+	}
+	codecs, err := m.KeyDeriver.Codecs(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(m.maxAge())
+		}
+	}
+	return codecs, nil
+}
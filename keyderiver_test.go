@@ -0,0 +1,62 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+type tenantKey struct{}
+
+func tenantInfo(ctx context.Context, session *sessions.Session) (string,
+	error) {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	if tenant == "" {
+		return "", errors.New("no tenant")
+	}
+	return tenant, nil
+}
+
+func TestMongoStoreKeyDeriver(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.KeyDeriver = &HKDFKeyDeriver{
+		Master: []byte("0123456789abcdef0123456789abcdef"),
+		Info:   tenantInfo,
+	}
+	acme := context.WithValue(context.Background(), tenantKey{}, "acme")
+	other := context.WithValue(context.Background(), tenantKey{}, "other")
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req = req.WithContext(acme)
+	session, _ := store.New(req, "session-key")
+	session.Values["user"] = "gopher"
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	s, err := store.FindSession(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("Error finding session: %v", err)
+	}
+	loaded := sessions.NewSession(store, "session-key")
+	if err = store.decode(acme, s, loaded); err != nil || loaded.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher with the tenant's keys; Got %v, %v",
+			loaded.Values["user"], err)
+	}
+	if err = store.decode(other, s, sessions.NewSession(store, "session-key")); err == nil {
+		t.Error("Expected another tenant's keys to fail")
+	}
+	if err = store.decode(context.Background(), s,
+		sessions.NewSession(store, "session-key")); err == nil {
+		t.Error("Expected an error without a tenant")
+	}
+
+	store.KeyDeriver = &HKDFKeyDeriver{Master: []byte("short"), Info: tenantInfo}
+	if _, err = store.document(acme, session); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("Expected ErrWeakKey for a short master key; Got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package mongostore
+
+// Logger receives debug output from a MongoStore. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// logOp logs the outcome of a store operation on the session with the given
+// ID, if a Logger is set.
+func (m *MongoStore) logOp(op, id string, err error) {
+	if m.Logger == nil {
+		return
+	}
+	if err != nil {
+		m.Logger.Printf("mongo-store: %s session %q: %v", op, id, err)
+		return
+	}
+	m.Logger.Printf("mongo-store: %s session %q", op, id)
+}
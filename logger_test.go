@@ -0,0 +1,30 @@
+package mongostore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMongoStoreLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	store := mustNewWeakKeyStore(nil, 3600, false, []byte("secret-key"))
+	store.Logger = log.New(buf, "", 0)
+
+	session := sessions.NewSession(store, "session-key")
+	session.ID = "not-an-object-id"
+	if err := store.load(context.Background(), session); !errors.Is(err, ErrInvalidId) {
+		t.Fatalf("Expected ErrInvalidId; Got %v", err)
+	}
+
+	want := `mongo-store: load session "not-an-object-id": ` +
+		ErrInvalidId.Error() + ` "not-an-object-id"`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("Expected %q; Got %q", want, got)
+	}
+}
@@ -0,0 +1,129 @@
+// Package memstore provides an in-memory mongostore.Store for tests of code
+// that uses sessions, so they can run without MongoDB.
+package memstore
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	mongostore "github.com/p000ic/go-mongo-store"
+)
+
+// MemStore keeps sessions in a map. Tokens are encoded with Codecs and
+// carried by Token exactly as MongoStore does, so handlers see the same
+// cookies. Sessions are lost when the store is discarded.
+type MemStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Token   mongostore.TokenGetSeter
+
+	mu       sync.Mutex
+	sessions map[string]map[interface{}]interface{}
+}
+
+var _ mongostore.Store = (*MemStore)(nil)
+
+// NewMemStore returns an empty store. Sessions expire from clients after
+// maxAge seconds but stay in memory until deleted.
+func NewMemStore(maxAge int, keyPairs ...[]byte) *MemStore {
+	store := &MemStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: maxAge,
+		},
+		Token:    &mongostore.CookieToken{},
+		sessions: map[string]map[interface{}]interface{}{},
+	}
+	for _, c := range store.Codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxAge(maxAge)
+		}
+	}
+	return store
+}
+
+// Get registers and returns a session for the given name and session store.
+// It returns a new session if there are no sessions registered for the name.
+func (m *MemStore) Get(r *http.Request, name string) (*sessions.Session,
+	error) {
+	return sessions.GetRegistry(r).Get(m, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry.
+func (m *MemStore) New(r *http.Request, name string) (*sessions.Session,
+	error) {
+	session := sessions.NewSession(m, name)
+	opts := *m.Options
+	session.Options = &opts
+	session.IsNew = true
+	cook, err := m.Token.GetToken(r, name)
+	if err != nil {
+		return session, nil
+	}
+	if err = securecookie.DecodeMulti(name, cook, &session.ID,
+		m.Codecs...); err != nil {
+		return session, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if values, ok := m.sessions[session.ID]; ok {
+		for k, v := range values {
+			session.Values[k] = v
+		}
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+// Save stores a copy of the session's values, or deletes the session if its
+// MaxAge is negative, and sets the token on w.
+func (m *MemStore) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		m.mu.Lock()
+		delete(m.sessions, session.ID)
+		m.mu.Unlock()
+		m.Token.SetToken(w, session.Name(), "", session.Options)
+		// As MongoStore does, empty the session the request's registry
+		// keeps, so a later Get does not see the deleted values.
+		session.ID = ""
+		session.IsNew = true
+		for k := range session.Values {
+			delete(session.Values, k)
+		}
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = primitive.NewObjectID().Hex()
+	}
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	m.mu.Lock()
+	m.sessions[session.ID] = values
+	m.mu.Unlock()
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		m.Codecs...)
+	if err != nil {
+		return err
+	}
+	m.Token.SetToken(w, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// Len returns the number of stored sessions.
+func (m *MemStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
@@ -0,0 +1,46 @@
+package memstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore(3600, []byte("0123456789abcdef0123456789abcdef"))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := httptest.NewRecorder()
+	session, err := store.New(req, "session-key")
+	if err != nil || !session.IsNew {
+		t.Fatalf("Expected a new session; Got %v", err)
+	}
+	session.Values["user"] = "gopher"
+	if err = store.Save(req, rsp, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	cookie := rsp.Header().Get("Set-Cookie")
+	session.Values["user"] = "changed"
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err = store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected the saved session; Got %v", err)
+	}
+	if session.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", session.Values["user"])
+	}
+
+	session.Options.MaxAge = -1
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if n := store.Len(); n != 0 {
+		t.Errorf("Expected no sessions; Got %d", n)
+	}
+	session, _ = store.New(req, "session-key")
+	if !session.IsNew {
+		t.Errorf("Expected a new session after delete")
+	}
+}
@@ -2,8 +2,14 @@ package mongostore
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/securecookie"
@@ -12,63 +18,508 @@ import (
 	"github.com/qiniu/qmgo/options"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	trueKey      = true
 	ErrInvalidId = errors.New("mongo-store: invalid session id")
+	// ErrSessionExpired is returned when a stored session is past its
+	// AbsoluteTimeout.
+	ErrSessionExpired = errors.New("mongo-store: session expired")
+	// ErrWeakKey is returned for key material too short to be safe.
+	ErrWeakKey = errors.New("mongo-store: insecure key")
+	// ErrNoKeys is returned when a store is given no key pairs, which
+	// would leave it unable to encode a single token.
+	ErrNoKeys = errors.New("mongo-store: at least one key pair is required")
+	// ErrSessionNotFound is returned when no document is stored for a
+	// session ID.
+	ErrSessionNotFound = errors.New("mongo-store: session not found")
+	// ErrSessionTooLarge is returned when a session's stored payload is
+	// larger than MaxValueBytes.
+	ErrSessionTooLarge = errors.New("mongo-store: session too large")
+	// ErrConcurrentModification is returned when a session changed in the
+	// store between being read and written back.
+	ErrConcurrentModification = errors.New("mongo-store: session modified " +
+		"concurrently")
+	// ErrDecode wraps failures to decode a session token or stored payload,
+	// such as after a key rotation gone wrong or a corrupted document.
+	ErrDecode = errors.New("mongo-store: failed to decode session")
+	// ErrStore wraps failures of MongoDB while loading a session.
+	ErrStore = errors.New("mongo-store: failed to load session")
 )
 
+// kindError wraps err so that errors.Is matches kind as well as err.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// IDError reports an error about a particular session ID. Err is the
+// underlying error, such as ErrInvalidId, so errors.Is still matches it.
+type IDError struct {
+	ID  string
+	Err error
+}
+
+func (e *IDError) Error() string {
+	return fmt.Sprintf("%v %q", e.Err, e.ID)
+}
+
+// Unwrap returns the underlying error.
+func (e *IDError) Unwrap() error {
+	return e.Err
+}
+
 // Session object store in MongoDB
 type Session struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	Data     string             `bson:"data"`
-	Modified time.Time          `bson:"modified"`
+	// ID is the session ID: the hex form of the ObjectID the document is
+	// stored under or, with StringIDs, the stored string itself.
+	ID         string    `bson:"_id,omitempty"`
+	Data       string    `bson:"data"`
+	Modified   time.Time `bson:"modified"`
+	Created    time.Time `bson:"created,omitempty"`
+	Compressed bool      `bson:"compressed,omitempty"`
+	Encrypted  bool      `bson:"encrypted,omitempty"`
+	// Plain marks Data as written with PlainData, base64 rather than
+	// encoded by the codecs.
+	Plain  bool   `bson:"plain,omitempty"`
+	UserID string `bson:"user_id,omitempty"`
+	// ExpiresAt is when the TTL index removes the document, from the
+	// session's own MaxAge at the last write.
+	ExpiresAt time.Time `bson:"expires_at,omitempty"`
+	// Accessed is when the session was last loaded, with TrackAccess.
+	Accessed time.Time `bson:"accessed,omitempty"`
+	// IP and UserAgent identify the client of the last Save, with
+	// RecordClient.
+	IP        string `bson:"ip,omitempty"`
+	UserAgent string `bson:"user_agent,omitempty"`
+	// Version counts the writes made with OptimisticLocking.
+	Version int64 `bson:"version,omitempty"`
+	// Namespace is the Namespace of the store that wrote the session.
+	Namespace string `bson:"namespace,omitempty"`
+	// DeletedAt is when the session was deleted with SoftDelete.
+	DeletedAt time.Time `bson:"deleted_at,omitempty"`
+	// Values holds the session values when the store uses RawValues, with
+	// the types BSON decodes them to, as described there.
+	Values bson.M `bson:"values,omitempty"`
+	// Indexed holds the IndexedFields values written as top-level fields.
+	// It is not filled in when documents are read.
+	Indexed map[string]string `bson:"-"`
 }
 
 // MongoStore stores sessions in MongoDB
 type MongoStore struct {
-	Codecs  []securecookie.Codec
-	Options *sessions.Options
-	Token   TokenGetSeter
-	coll    *qmgo.Collection
+	// Codecs encode the tokens and payloads. Replace them on a store in use
+	// with RotateKeys, which also reaches the stores derived from it.
+	Codecs     []securecookie.Codec
+	Options    *sessions.Options
+	Token      TokenGetSeter
+	Serializer Serializer
+	// Compress gzips the serialized values before they are encoded and
+	// stored. Documents written without compression still load.
+	Compress bool
+	// Encrypter, if set, encrypts the serialized, possibly compressed,
+	// values before they are encoded by the codecs, so the stored payload
+	// is encrypted even with a hash-only key pair. Documents written
+	// without it still load. It is not applied to RawValues.
+	Encrypter Encrypter
+	// UserIDKey names the session value copied into the stored document's
+	// user_id field so sessions can be found by user. Empty disables it.
+	UserIDKey string
+	// RawValues stores session.Values as a BSON subdocument in the values
+	// field instead of an encoded string, so documents can be inspected and
+	// queried. The payload is not signed or encrypted, keys must be strings
+	// and values must be BSON-encodable; Serializer and Compress are unused.
+	//
+	// Values are loaded back as BSON decodes them rather than as the types
+	// saved: an int comes back as int32 if it fits and int64 otherwise, a
+	// float32 as float64, structs and maps as bson.M, with struct fields
+	// named by their bson tags or else in lower case, slices as bson.A and
+	// time.Time as primitive.DateTime. Type assertions on loaded values must
+	// expect these types.
+	RawValues bool
+	// OpTimeout bounds each Mongo call made by load, upsert and delete.
+	// Zero means no timeout beyond the caller's context.
+	OpTimeout time.Duration
+	// AbsoluteTimeout caps a session's lifetime from its first save,
+	// however recently it was modified. Zero means no cap.
+	AbsoluteTimeout time.Duration
+	// TTLJitter, if positive, brings each save's expiry forward by a random
+	// offset in [0, TTLJitter), so sessions created together, say in a
+	// morning login spike, do not all expire at once. It is taken off
+	// rather than added because the token's own MaxAge would otherwise end
+	// the session first. It only applies to sessions stored with an
+	// expires_at, that is ones with a positive MaxAge, and should stay well
+	// below MaxAge.
+	TTLJitter time.Duration
+	// ExpiryFunc, if set, gives the lifetime of each session when it is
+	// written, say shorter for admin sessions, in place of MaxAge. A result
+	// of zero or less falls back to MaxAge. The TTL index removes each
+	// document at its own expires_at, so no index change is needed, but
+	// the token still expires after the codecs' MaxAge: keep lifetimes
+	// within it, or the session ends with its token first.
+	ExpiryFunc func(session *sessions.Session) time.Duration
+	// Cache, if set, holds loaded sessions in front of MongoDB for CacheTTL,
+	// five seconds by default. The store's own writes and deletes drop them,
+	// but changes made elsewhere are served stale until CacheTTL passes.
+	Cache    Cache
+	CacheTTL time.Duration
+	// Logger, if set, receives a line for every load, upsert and delete.
+	Logger Logger
+	// Tracer, if set, records a span for every load, upsert and delete,
+	// parented to the context passed to the *Context methods.
+	Tracer trace.Tracer
+	// Metrics, if set, is told the duration and result of every load,
+	// upsert and delete.
+	Metrics MetricsObserver
+	// AllowWeakKeys skips the key length checks of ValidateKeyPairs. Set it
+	// at construction with WithWeakKeys, for tests using short keys; set
+	// afterwards, it only affects RotateKeys. NewMongoStore always validates.
+	AllowWeakKeys bool
+	// FieldNames renames the id, data and modified fields of stored
+	// documents, for collections shared with other schemas. Set it before
+	// the store is used and call EnsureIndexes to index the renamed fields.
+	FieldNames FieldNames
+	// MaxListLimit caps the limit accepted by List. Zero means 1000.
+	MaxListLimit int64
+	// Now returns the current time used for modified timestamps and expiry
+	// checks. It defaults to time.Now; tests can set a fixed clock.
+	Now func() time.Time
+	// WriteConcern, if set, is used for the writes of Save and the deletes
+	// of logout and DeleteByID. writeconcern.New(writeconcern.WMajority())
+	// makes a logout survive a failover at the cost of waiting for a
+	// majority of the replica set. Nil keeps the client's default.
+	WriteConcern *writeconcern.WriteConcern
+	// Unacknowledged sends the writes of Save and the deletes of logout and
+	// DeleteByID with write concern w:0, overriding WriteConcern, so they
+	// return without waiting for the server. It trades durability for
+	// latency: a write rejected by the server or lost in a crash or
+	// failover is never reported, and a logout may not log the user out.
+	// Use it only for sessions that are cheap to lose. OptimisticLocking and
+	// SaveBatch still wait for acknowledgement.
+	Unacknowledged bool
+	// ReadConcern, if set, is used for the reads of New. "local" is fastest
+	// but may return a write that is later rolled back; "majority" only
+	// sees data that survives a failover. Nil keeps the client's default.
+	ReadConcern *readconcern.ReadConcern
+	// ReadPreference, if set, selects the replica set members New loads
+	// sessions from; Save and delete always go to the primary. Reading
+	// from secondaries spreads load but they may lag, so a session saved
+	// moments ago can be missing or stale and come back as a new session.
+	// Nil keeps the client's default, normally the primary.
+	ReadPreference *readpref.ReadPref
+	// DocumentDBCompat builds indexes Amazon DocumentDB accepts: the TTL
+	// index is neither sparse nor unique, whatever UniqueTTLIndex says. Set
+	// it on a store made with ensureTTL false and then call EnsureIndexes.
+	DocumentDBCompat bool
+	// UniqueTTLIndex makes EnsureIndexes create the TTL index as unique, as
+	// older versions did. Sessions written in the same instant then collide,
+	// so leave it off unless an existing deployment's index requires it.
+	UniqueTTLIndex bool
+	// IDGenerator, if set, returns the IDs of new sessions. By default they
+	// are hex ObjectIDs. IDs that are not ObjectIDs, such as UUIDs, need
+	// StringIDs.
+	IDGenerator func() string
+	// StringIDs stores session IDs as strings in _id instead of ObjectIDs,
+	// so any IDGenerator can be used. ObjectIDs embed their creation time,
+	// which random string IDs avoid revealing, but string IDs take more
+	// space in the _id index, and each mode only reads its own documents.
+	StringIDs bool
+	// Namespace, if set, is stored with every session and added to the
+	// filter of every read, write and delete, so apps sharing a collection
+	// under different namespaces never see each other's sessions, even
+	// under the same ID. Saving over an ID another namespace holds fails
+	// with a duplicate key error. Sessions stored before it was set, or
+	// under another value, are not found; EnsureIndexes indexes it.
+	Namespace string
+	// IndexedFields lists session value keys copied into top-level string
+	// fields of the stored document, for example "tenant_id", so sessions
+	// can be found with FindByField. EnsureIndexes indexes each. Saving a
+	// session whose value under one of these keys is not a string fails.
+	IndexedFields []string
+	// RespectModifiedValue takes the stored modified time from a time.Time
+	// under the "modified" session value, as older versions did, instead of
+	// the current time. A value of another type then fails the save.
+	RespectModifiedValue bool
+	// LegacyKidstuffMode reads the documents of kidstuff/mongostore, whose
+	// data is decoded with Codecs and which expire MaxAge after modified,
+	// and rewrites them in this store's format when saved. FieldNames,
+	// StringIDs and RawValues must be left unset.
+	LegacyKidstuffMode bool
+	// TrackAccess records in the accessed field when each session was last
+	// loaded. This makes every load also write, so the update is sent in
+	// the background without waiting for it: it adds little latency, but
+	// failures are only logged. It is bounded by OpTimeout, not the
+	// request's context.
+	TrackAccess bool
+	// PlainData stores the serialized, possibly compressed and encrypted,
+	// values base64-encoded instead of encoded by the codecs, skipping the
+	// securecookie signing and encryption of the payload. Use it only when
+	// session IDs are unguessable and the database is trusted, as the
+	// payload can then be read and altered there. Documents are marked, so
+	// either mode loads what the other wrote.
+	PlainData bool
+	// OnLoad, OnSave and OnDelete, if set, are called once a session has
+	// been loaded by New, saved by Save or deleted by a Save with a
+	// negative MaxAge, with the error of the operation or nil. They run
+	// synchronously in the caller's goroutine, so slow work such as
+	// publishing an audit event should be handed off.
+	OnLoad   func(session *sessions.Session, err error)
+	OnSave   func(session *sessions.Session, err error)
+	OnDelete func(session *sessions.Session, err error)
+	// OnMissingID, if set, is called by New with the ID of a validly signed
+	// token that has no stored session, because it expired and was removed
+	// or was deleted on logout, before a new session is returned. A burst of
+	// them can point to replayed tokens worth rate-limiting or alerting on.
+	OnMissingID func(id string)
+	// MaxValueBytes, if positive, caps the size of a session's stored
+	// payload, the encoded data or, with RawValues, the BSON values. Saving
+	// a larger session fails with ErrSessionTooLarge before anything is
+	// written, rather than with the driver's error once the document
+	// passes MongoDB's 16MB limit.
+	MaxValueBytes int
+	// RecordClient stores the IP address and User-Agent of the request in
+	// each Save, for listing a user's devices. Leave it off where recording
+	// them is not acceptable; documents saved with it off have neither.
+	RecordClient bool
+	// TrustedProxies lists the addresses, as IPs or CIDR blocks, of proxies
+	// whose X-Forwarded-For header RecordClient believes. Requests from
+	// other addresses are recorded under their own address.
+	TrustedProxies []string
+	// OptimisticLocking makes Save fail with ErrConcurrentModification
+	// instead of overwriting a session that another request saved since it
+	// was loaded, detected by a version field bumped on every write. The
+	// loaded version is kept in the session's Values under an unexported
+	// key, which is never stored. Sessions that are new when saved are
+	// written unconditionally.
+	OptimisticLocking bool
+	// KeyDeriver, if set, provides the codecs that encode and decode each
+	// session's stored payload in place of Codecs, for example to encrypt
+	// every tenant's sessions with its own key. Tokens are still encoded
+	// with Codecs. Sessions written with other codecs no longer load.
+	KeyDeriver KeyDeriver
+	// CollectionResolver, if set, returns the collection sessions called
+	// name are stored in, so one store can keep, for example, "auth" and
+	// "cart" sessions apart. It is used when sessions are loaded, saved,
+	// touched, deleted and regenerated; a nil result means the store's own
+	// collection, which the methods taking only an ID always use. Indexes
+	// are only created on the store's own collection; call EnsureIndexes
+	// on WithCollection for each of the others.
+	CollectionResolver func(name string) *qmgo.Collection
+	// SlideOnLoad moves a session's modified time, and so its expiry, to
+	// now every time it is loaded, as Touch does, so it lives as long as it
+	// is used rather than as long as it is saved. This makes every load
+	// also write.
+	SlideOnLoad bool
+	// RetryPolicy retries load, upsert and delete on transient errors. The
+	// zero value makes a single attempt.
+	RetryPolicy RetryPolicy
+	// CappedSize, if positive, makes EnsureIndexes create the collection
+	// capped at that many bytes, and CappedMax at that many documents. It
+	// has no TTL index, and logouts mark sessions expired instead of
+	// removing them.
+	CappedSize int64
+	CappedMax  int64
+	// SoftDelete makes logouts, DeleteByID and RegenerateID keep the
+	// deleted session as a tombstone with a deleted_at time, for
+	// investigating replayed tokens, instead of removing it. Loading,
+	// counting, listing, searching and exporting sessions leave tombstones
+	// out, and New calls OnMissingID for one; FindSession still returns it,
+	// and saving over its ID fails. PurgeDeleted removes tombstones once
+	// their grace period is over, and the TTL index still removes them at
+	// their expires_at. The bulk deletes, such as DeleteByUserID and Clear,
+	// remove documents outright. It has no effect on capped collections.
+	SoftDelete bool
+	coll       *qmgo.Collection
+	// keys holds the codecs installed by RotateKeys, shared with the stores
+	// derived by WithCollection.
+	keys *keyring
+	// accessing counts the markAccessed updates Close waits for.
+	accessing *sync.WaitGroup
+	// client is the client Close disconnects, set only when the store
+	// created it.
+	client *qmgo.Client
 }
 
+// defaultIndexTimeout bounds the index creation of NewMongoStore.
+const defaultIndexTimeout = time.Minute
+
 // NewMongoStore returns a new MongoStore.
-// Set ensureTTL to true let the database auto-remove expired object by maxAge.
+// Set ensureTTL to true let the database auto-remove expired object by maxAge;
+// this also indexes the user_id field used by DeleteByUserID.
+// keyPairs are checked with ValidateKeyPairs.
+// Creating the indexes fails after a minute; use NewMongoStoreContext to
+// choose the deadline.
 func NewMongoStore(c *qmgo.Collection, maxAge int, ensureTTL bool,
-	keyPairs ...[]byte) *MongoStore {
-	store := &MongoStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: maxAge,
-		},
-		Token: &CookieToken{},
-		coll:  c,
+	keyPairs ...[]byte) (*MongoStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		defaultIndexTimeout)
+	defer cancel()
+	return NewMongoStoreContext(ctx, c, maxAge, ensureTTL, keyPairs...)
+}
+
+// NewMongoStoreContext is like NewMongoStore but creates the indexes under
+// ctx, so an unreachable server fails it once ctx is done.
+func NewMongoStoreContext(ctx context.Context, c *qmgo.Collection, maxAge int,
+	ensureTTL bool, keyPairs ...[]byte) (*MongoStore, error) {
+	opts := []Option{WithMaxAge(maxAge), WithKeys(keyPairs...)}
+	if ensureTTL {
+		opts = append(opts, WithTTL())
 	}
+	return newStore(ctx, c, opts...)
+}
 
-	store.MaxAge(maxAge)
+// EnsureIndexes creates the TTL index on the expires_at field, removing each
+// session once its own MaxAge has passed, and the user_id index used by
+// DeleteByUserID. NewMongoStore calls it when ensureTTL is set; call it
+// yourself after changing FieldNames. Documents written before expires_at was
+// introduced are not expired by the index; remove them with Prune.
+//
+// Indexes that already exist with the same options are left alone, so it is
+// safe to call on every start. An existing index on the same keys with other
+// options is not replaced; the error names it so it can be dropped. With
+// CappedSize it first creates the capped collection.
+func (m *MongoStore) EnsureIndexes(ctx context.Context) error {
+	if m.capped() {
+		if err := m.ensureCapped(ctx); err != nil {
+			return fmt.Errorf("mongo-store: failed to create capped "+
+				"collection: %w", err)
+		}
+	}
+	for _, model := range m.indexModels() {
+		err := m.coll.CreateOneIndex(ctx, model)
+		if err == nil {
+			continue
+		}
+		keys := strings.Join(model.Key, ", ")
+		var se mongo.ServerError
+		if errors.As(err, &se) && (se.HasErrorCode(errIndexOptionsConflict) ||
+			se.HasErrorCode(errIndexKeySpecsConflict)) {
+			return fmt.Errorf("mongo-store: an index on %s already exists "+
+				"with different options, drop it and call EnsureIndexes "+
+				"again: %w", keys, err)
+		}
+		return fmt.Errorf("mongo-store: failed to create index on %s: %w",
+			keys, err)
+	}
+	return nil
+}
 
-	if ensureTTL {
-		exp := int32(time.Duration(maxAge) * time.Second)
-		indexKey := []options.IndexModel{
-			{Key: []string{"modified"}, IndexOptions: &mongoOpts.IndexOptions{
-				ExpireAfterSeconds: &exp,
-				Sparse:             &trueKey,
-				Unique:             &trueKey,
-			}},
-		}
-		err := c.CreateIndexes(context.Background(), indexKey)
-		if err != nil {
-			return nil
+// Server error codes for an index that exists with other options.
+const (
+	errIndexOptionsConflict  = 85
+	errIndexKeySpecsConflict = 86
+)
+
+// indexModels returns the indexes created by EnsureIndexes.
+func (m *MongoStore) indexModels() []options.IndexModel {
+	var exp int32
+	ttl := &mongoOpts.IndexOptions{ExpireAfterSeconds: &exp}
+	if !m.DocumentDBCompat {
+		ttl.Sparse = &trueKey
+		if m.UniqueTTLIndex {
+			ttl.Unique = &trueKey
 		}
 	}
+	var indexKey []options.IndexModel
+	if !m.capped() {
+		indexKey = append(indexKey, options.IndexModel{
+			Key: []string{"expires_at"}, IndexOptions: ttl,
+		})
+	}
+	indexKey = append(indexKey, options.IndexModel{
+		Key:          []string{"user_id"},
+		IndexOptions: &mongoOpts.IndexOptions{Sparse: &trueKey},
+	})
+	if m.Namespace != "" {
+		indexKey = append(indexKey, options.IndexModel{
+			Key:          []string{"namespace"},
+			IndexOptions: &mongoOpts.IndexOptions{Sparse: &trueKey},
+		})
+	}
+	for _, field := range m.IndexedFields {
+		indexKey = append(indexKey, options.IndexModel{
+			Key:          []string{field},
+			IndexOptions: &mongoOpts.IndexOptions{Sparse: &trueKey},
+		})
+	}
+	if f := m.fields(); f.ID != "_id" {
+		indexKey = append(indexKey, options.IndexModel{
+			Key:          []string{f.ID},
+			IndexOptions: &mongoOpts.IndexOptions{Unique: &trueKey},
+		})
+	}
+	return indexKey
+}
 
+// ValidateKeyPairs checks key pairs as passed to securecookie.CodecsFromPairs:
+// each hash key must be at least 32 bytes and each encryption key, if given,
+// 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256. A single hash key
+// authenticates the payload but does not encrypt it. No key pairs at all
+// give ErrNoKeys.
+func ValidateKeyPairs(keyPairs ...[]byte) error {
+	if len(keyPairs) == 0 {
+		return ErrNoKeys
+	}
+	for i := 0; i < len(keyPairs); i += 2 {
+		if n := len(keyPairs[i]); n < 32 {
+			return fmt.Errorf("%w: hash key %d is %d bytes, want at least 32",
+				ErrWeakKey, i/2, n)
+		}
+		if i+1 >= len(keyPairs) || keyPairs[i+1] == nil {
+			continue
+		}
+		switch n := len(keyPairs[i+1]); n {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("%w: encryption key %d is %d bytes, want 16, 24 or 32",
+				ErrWeakKey, i/2, n)
+		}
+	}
+	return nil
+}
+
+// MustNewMongoStore is like NewMongoStore but panics if the store cannot be
+// created.
+func MustNewMongoStore(c *qmgo.Collection, maxAge int, ensureTTL bool,
+	keyPairs ...[]byte) *MongoStore {
+	store, err := NewMongoStore(c, maxAge, ensureTTL, keyPairs...)
+	if err != nil {
+		panic(err)
+	}
 	return store
 }
 
+// ttlSeconds clamps maxAge, in seconds, to the range 0 to math.MaxInt32, the
+// range a TTL index's expireAfterSeconds accepts.
+func ttlSeconds(maxAge int) int32 {
+	if maxAge < 0 {
+		return 0
+	}
+	if int64(maxAge) > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(maxAge)
+}
+
 // Get registers and returns a session for the given name and session store.
 // It returns a new session if there are no sessions registered for the name.
 func (m *MongoStore) Get(r *http.Request, name string) (
@@ -76,26 +527,58 @@ func (m *MongoStore) Get(r *http.Request, name string) (
 	return sessions.GetRegistry(r).Get(m, name)
 }
 
+// GetContext is like Get but uses ctx for the underlying Mongo calls instead
+// of the request context. The returned session stays bound to ctx, so a later
+// sessions.Save for the same request also runs under it.
+func (m *MongoStore) GetContext(ctx context.Context, r *http.Request,
+	name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(&contextStore{m: m, ctx: ctx}, name)
+}
+
 // New returns a session for the given name without adding it to the registry.
 func (m *MongoStore) New(r *http.Request, name string) (
 	*sessions.Session, error) {
+	return m.NewContext(r.Context(), r, name)
+}
+
+// NewContext is like New but uses ctx for the underlying Mongo calls.
+// A token for a session that is missing or expired yields a new session,
+// which Save stores under a new ID; other errors, such as an unreachable database, are returned along with it.
+// Errors decoding the token or stored payload match ErrDecode and database
+// errors match ErrStore.
+func (m *MongoStore) NewContext(ctx context.Context, r *http.Request,
+	name string) (*sessions.Session, error) {
 	session := sessions.NewSession(m, name)
+	opts := m.options()
 	session.Options = &sessions.Options{
-		Path:     m.Options.Path,
-		MaxAge:   m.Options.MaxAge,
-		Domain:   m.Options.Domain,
-		Secure:   m.Options.Secure,
-		HttpOnly: m.Options.HttpOnly,
+		Path:     opts.Path,
+		MaxAge:   opts.MaxAge,
+		Domain:   opts.Domain,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.SameSite,
 	}
 	session.IsNew = true
 	var err error
 	if cook, errToken := m.Token.GetToken(r, name); errToken == nil {
-		err = securecookie.DecodeMulti(name, cook, &session.ID, m.Codecs...)
-		if err == nil {
-			err = m.load(session)
+		session.ID, err = m.decodeToken(name, cook)
+		if err != nil {
+			err = &kindError{kind: ErrDecode, err: err}
+		} else {
+			err = m.load(ctx, session)
 			if err == nil {
 				session.IsNew = false
-			} else {
+			} else if errors.Is(err, ErrSessionNotFound) {
+				if m.OnMissingID != nil {
+					m.OnMissingID(session.ID)
+				}
+				// Save then starts afresh rather than writing over a
+				// deleted session.
+				session.ID = ""
+				err = nil
+			} else if errors.Is(err, ErrSessionExpired) {
+				// Likewise, so the new session gets a new created time.
+				session.ID = ""
 				err = nil
 			}
 		}
@@ -103,27 +586,69 @@ func (m *MongoStore) New(r *http.Request, name string) (
 	return session, err
 }
 
+// DecodeID returns the session ID carried by the token value of the session
+// called name, without querying MongoDB, so tampered, expired or garbage
+// tokens can be rejected early. It does not check that the session exists.
+func (m *MongoStore) DecodeID(name, value string) (string, error) {
+	id, err := m.decodeToken(name, value)
+	if err != nil {
+		return "", fmt.Errorf("mongo-store: invalid session token: %w", err)
+	}
+	if _, err := m.parseID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// encodeToken returns the token carrying id for the session called name:
+// encoded by Token if it is a TokenEncoder, else by the codecs.
+func (m *MongoStore) encodeToken(name, id string) (string, error) {
+	if enc, ok := m.Token.(TokenEncoder); ok {
+		return enc.EncodeToken(name, id)
+	}
+	return securecookie.EncodeMulti(name, id, m.codecs()...)
+}
+
+// decodeToken returns the session ID carried by token, undoing encodeToken.
+func (m *MongoStore) decodeToken(name, token string) (string, error) {
+	if enc, ok := m.Token.(TokenEncoder); ok {
+		return enc.DecodeToken(name, token)
+	}
+	var id string
+	err := securecookie.DecodeMulti(name, token, &id, m.codecs()...)
+	return id, err
+}
+
 // Save saves all sessions registered for the current request.
 func (m *MongoStore) Save(r *http.Request, w http.ResponseWriter,
 	session *sessions.Session) error {
+	return m.SaveContext(r.Context(), r, w, session)
+}
+
+// SaveContext is like Save but uses ctx for the underlying Mongo calls.
+// Errors caused by ctx, such as context.Canceled, are returned unwrapped.
+func (m *MongoStore) SaveContext(ctx context.Context, r *http.Request,
+	w http.ResponseWriter, session *sessions.Session) error {
 	if session.Options.MaxAge < 0 {
-		if err := m.delete(session); err != nil {
-			return err
+		if session.ID != "" {
+			if err := m.delete(ctx, session); err != nil {
+				return err
+			}
 		}
 		m.Token.SetToken(w, session.Name(), "", session.Options)
+		reset(session)
 		return nil
 	}
 
 	if session.ID == "" {
-		session.ID = primitive.NewObjectID().Hex()
+		session.ID = m.newID()
 	}
 
-	if err := m.upsert(session); err != nil {
+	if err := m.upsert(ctx, r, session); err != nil {
 		return err
 	}
 
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		m.Codecs...)
+	encoded, err := m.encodeToken(session.Name(), session.ID)
 	if err != nil {
 		return err
 	}
@@ -132,6 +657,181 @@ func (m *MongoStore) Save(r *http.Request, w http.ResponseWriter,
 	return nil
 }
 
+// DeleteWithResult logs session out as Save does when Options.MaxAge is
+// negative, whatever its MaxAge, deleting the stored session and telling the
+// client to forget its token, and reports whether a stored session was
+// actually deleted. A session that was never saved, or is already gone,
+// gives false and no error, so callers can tell a logout from a repeated
+// one. Unacknowledged deletes cannot tell and report true.
+func (m *MongoStore) DeleteWithResult(ctx context.Context,
+	w http.ResponseWriter, session *sessions.Session) (bool, error) {
+	deleted := true
+	if session.ID == "" {
+		deleted = false
+	} else if err := m.delete(ctx, session); err == ErrSessionNotFound {
+		deleted = false
+	} else if err != nil {
+		return false, err
+	}
+	opts := m.options()
+	if session.Options != nil {
+		opts = *session.Options
+	}
+	opts.MaxAge = -1
+	m.Token.SetToken(w, session.Name(), "", &opts)
+	reset(session)
+	return deleted, nil
+}
+
+// reset empties a deleted session, which the request's sessions.Registry
+// keeps handing out, so a later Get in the same request sees a new session
+// rather than the deleted one's values. Options are kept, so saving it again
+// still only clears the token.
+func reset(session *sessions.Session) {
+	session.ID = ""
+	session.IsNew = true
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+}
+
+// RegenerateID moves the session to a newly generated ID, keeping its values,
+// and deletes the document stored under the old ID. Call it after a user
+// authenticates to prevent session fixation; the next Save emits a token for
+// the new ID.
+func (m *MongoStore) RegenerateID(session *sessions.Session) error {
+	return m.RegenerateIDContext(context.Background(), session)
+}
+
+// RegenerateIDContext is like RegenerateID but uses ctx for the underlying
+// Mongo calls. Once the session is written under the new ID the rotation has
+// happened, so an old document that is already gone is not an error.
+func (m *MongoStore) RegenerateIDContext(ctx context.Context,
+	session *sessions.Session) error {
+	m = m.forName(session.Name())
+	oldID := session.ID
+	var created time.Time
+	if key, err := m.parseID(oldID); err == nil {
+		// Carry the created time over so AbsoluteTimeout still applies.
+		if prev, err := m.find(ctx, key, bson.M{"created": 1}, nil); err == nil {
+			created = prev.Created
+		}
+	}
+
+	session.ID = m.newID()
+	s, err := m.document(ctx, session)
+	if err == nil {
+		s.Created = created
+		err = m.write(ctx, s)
+	}
+	if err != nil {
+		session.ID = oldID
+		return err
+	}
+	if m.OptimisticLocking {
+		session.Values[versionKey{}] = s.Version
+	}
+
+	if oldID == "" {
+		return nil
+	}
+	if err = m.deleteID(ctx, oldID); err != ErrSessionNotFound {
+		return err
+	}
+	return nil
+}
+
+// Touch sets the stored modified time of session to now without rewriting
+// its data, pushing back its expiry by session.Options.MaxAge. It returns
+// ErrSessionNotFound if session is not stored, is a SoftDelete tombstone or
+// was logged out of a capped collection.
+func (m *MongoStore) Touch(ctx context.Context,
+	session *sessions.Session) error {
+	m = m.forName(session.Name())
+	key, err := m.parseID(session.ID)
+	if err != nil {
+		return err
+	}
+
+	now := m.now()
+	set := bson.M{m.fields().Modified: now}
+	if expires := m.expiresAt(session, now); !expires.IsZero() {
+		set["expires_at"] = expires
+	}
+	defer m.uncache(session.ID)
+	err = m.coll.UpdateOne(ctx, m.liveIDFilter(key), bson.M{"$set": set})
+	if err == qmgo.ErrNoSuchDocuments {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// Collection returns the collection sessions are stored in, for queries the
+// store does not provide. Documents follow the Session struct and FieldNames.
+func (m *MongoStore) Collection() *qmgo.Collection {
+	return m.coll
+}
+
+// Ping checks that the MongoDB deployment holding the collection is
+// reachable, for readiness checks. It is bounded by ctx and OpTimeout.
+func (m *MongoStore) Ping(ctx context.Context) error {
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := m.opContext(ctx)
+	defer cancel()
+	return c.Database().Client().Ping(ctx, nil)
+}
+
+// WithCollection returns a shallow copy of the store that reads and writes
+// sessions in c. The copy shares the codecs, options and other settings of m,
+// so changes made through either store's Options, and keys rotated on either
+// with RotateKeys, are seen by both.
+func (m *MongoStore) WithCollection(c *qmgo.Collection) *MongoStore {
+	store := *m
+	store.coll = c
+	store.client = nil
+	return &store
+}
+
+// Close waits for pending TrackAccess updates and, if the store created its
+// client, as NewMongoStoreFromConfig does, disconnects it. ctx bounds both.
+// Stores built on a caller's collection leave the client open, since it may
+// be shared; the caller closes it. So do stores returned by WithCollection.
+// The store must not be used after Close.
+func (m *MongoStore) Close(ctx context.Context) error {
+	if m.accessing != nil {
+		done := make(chan struct{})
+		go func() {
+			m.accessing.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if m.client == nil {
+		return nil
+	}
+	return m.client.Close(ctx)
+}
+
+// forName returns the store for sessions called name: m with the collection
+// from CollectionResolver, if it gives one.
+func (m *MongoStore) forName(name string) *MongoStore {
+	if m.CollectionResolver == nil {
+		return m
+	}
+	c := m.CollectionResolver(name)
+	if c == nil || c == m.coll {
+		return m
+	}
+	return m.WithCollection(c)
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
@@ -139,70 +839,406 @@ func (m *MongoStore) MaxAge(age int) {
 	m.Options.MaxAge = age
 
 	// Set the maxAge for each securecookie instance.
-	for _, codec := range m.Codecs {
+	for _, codec := range m.codecs() {
 		if sc, ok := codec.(*securecookie.SecureCookie); ok {
 			sc.MaxAge(age)
 		}
 	}
 }
 
-func (m *MongoStore) load(session *sessions.Session) error {
-	if !primitive.IsValidObjectID(session.ID) {
-		return ErrInvalidId
+// RotateKeys replaces the store's codecs with ones built from keyPairs, which
+// are ordered newest first: tokens and payloads are written with the first
+// pair, while every pair is tried when decoding. To phase in a new key, pass
+// it ahead of the current ones; once old sessions have expired, rotate again
+// without the old keys. The store's MaxAge is applied to the new codecs.
+// It is safe to call while the store is serving requests, and the stores
+// derived from it with WithCollection, including those for
+// CollectionResolver, switch to the new codecs too.
+func (m *MongoStore) RotateKeys(keyPairs ...[]byte) error {
+	if len(keyPairs) == 0 {
+		return ErrNoKeys
+	}
+	if !m.AllowWeakKeys {
+		if err := ValidateKeyPairs(keyPairs...); err != nil {
+			return err
+		}
 	}
 
-	oID, err := primitive.ObjectIDFromHex(session.ID)
-	if err != nil {
-		return err
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(m.maxAge())
+		}
+	}
+
+	m.setCodecs(codecs)
+	return nil
+}
+
+// keyring holds the codecs of a store and of the copies WithCollection makes
+// of it, so replacing them on one replaces them on all. Its lock also guards
+// the MaxAge of the shared Options against SetTTL.
+type keyring struct {
+	mu sync.RWMutex
+	// codecs replace Codecs once set.
+	codecs []securecookie.Codec
+}
+
+// codecs returns the current codecs.
+func (m *MongoStore) codecs() []securecookie.Codec {
+	if m.keys == nil {
+		return m.Codecs
+	}
+	m.keys.mu.RLock()
+	defer m.keys.mu.RUnlock()
+	if m.keys.codecs == nil {
+		return m.Codecs
+	}
+	return m.keys.codecs
+}
+
+// options returns a copy of Options, read under the lock SetTTL changes
+// MaxAge under.
+func (m *MongoStore) options() sessions.Options {
+	if m.keys == nil {
+		return *m.Options
+	}
+	m.keys.mu.RLock()
+	defer m.keys.mu.RUnlock()
+	return *m.Options
+}
+
+// maxAge returns Options.MaxAge, as options does.
+func (m *MongoStore) maxAge() int {
+	return m.options().MaxAge
+}
+
+// setCodecs replaces the codecs of m and of the stores sharing its keyring.
+func (m *MongoStore) setCodecs(codecs []securecookie.Codec) {
+	if m.keys == nil {
+		m.Codecs = codecs
+		return
 	}
+	m.keys.mu.Lock()
+	defer m.keys.mu.Unlock()
+	m.keys.codecs = codecs
+	m.Codecs = codecs
+}
+
+// maxStringIDLen bounds the session IDs accepted with StringIDs.
+const maxStringIDLen = 256
+
+// newID returns the ID for a new session.
+func (m *MongoStore) newID() string {
+	if m.IDGenerator != nil {
+		return m.IDGenerator()
+	}
+	return primitive.NewObjectID().Hex()
+}
+
+// parseID converts a session ID to the _id it is stored under: an ObjectID
+// from its hex form or, with StringIDs, the string itself.
+func (m *MongoStore) parseID(id string) (interface{}, error) {
+	if m.StringIDs {
+		if id == "" || len(id) > maxStringIDLen {
+			return nil, &IDError{ID: id, Err: ErrInvalidId}
+		}
+		return id, nil
+	}
+	if !primitive.IsValidObjectID(id) {
+		return nil, &IDError{ID: id, Err: ErrInvalidId}
+	}
+
+	return primitive.ObjectIDFromHex(id)
+}
+
+// now returns the current time from Now, falling back to time.Now.
+func (m *MongoStore) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+	return m.Now()
+}
+
+// opContext derives the context for a single Mongo call, applying OpTimeout.
+func (m *MongoStore) opContext(ctx context.Context) (context.Context,
+	context.CancelFunc) {
+	if m.OpTimeout > 0 {
+		return context.WithTimeout(ctx, m.OpTimeout)
+	}
+	return ctx, func() {}
+}
 
-	s := Session{}
-	err = m.coll.Find(context.Background(), bson.M{"_id": oID}).One(&s)
+func (m *MongoStore) load(ctx context.Context,
+	session *sessions.Session) (err error) {
+	m = m.forName(session.Name())
+	ctx, end := m.startOp(ctx, "load", session.ID)
+	defer func() {
+		end(err)
+		callHook(m.OnLoad, session, err)
+	}()
+
+	key, err := m.parseID(session.ID)
 	if err != nil {
 		return err
 	}
 
-	if err := securecookie.DecodeMulti(session.Name(), s.Data, &session.Values,
-		m.Codecs...); err != nil {
-		return err
+	s := m.cached(session.ID)
+	if s == nil {
+		err = m.retry(ctx, func(ctx context.Context) (err error) {
+			ctx, cancel := m.opContext(ctx)
+			defer cancel()
+			s, err = m.find(ctx, key, nil, m.ReadPreference)
+			return err
+		})
+		if err == ErrSessionNotFound {
+			return err
+		}
+		if err != nil {
+			return &kindError{kind: ErrStore, err: err}
+		}
+		m.cache(s)
 	}
 
+	if !s.DeletedAt.IsZero() {
+		return ErrSessionNotFound
+	}
+	if m.expired(s) || m.legacyExpired(s) {
+		return ErrSessionExpired
+	}
+
+	if err = m.decode(ctx, s, session); err != nil {
+		return &kindError{kind: ErrDecode, err: err}
+	}
+	if m.OptimisticLocking {
+		session.Values[versionKey{}] = s.Version
+	}
+	if m.SlideOnLoad {
+		err = m.retry(ctx, func(ctx context.Context) error {
+			ctx, cancel := m.opContext(ctx)
+			defer cancel()
+			return m.Touch(ctx, session)
+		})
+		if err != nil {
+			return &kindError{kind: ErrStore, err: err}
+		}
+	}
+	if m.TrackAccess {
+		if m.accessing != nil {
+			m.accessing.Add(1)
+		}
+		go m.markAccessed(session.ID, key)
+	}
 	return nil
 }
 
-func (m *MongoStore) upsert(session *sessions.Session) error {
-	if !primitive.IsValidObjectID(session.ID) {
-		return ErrInvalidId
+// markAccessed sets the accessed time of the session id, stored under key,
+// logging rather than returning any error. It runs after the request may
+// have finished, so it does not use the request's context.
+func (m *MongoStore) markAccessed(id string, key interface{}) {
+	if m.accessing != nil {
+		defer m.accessing.Done()
 	}
+	ctx, cancel := m.opContext(context.Background())
+	defer cancel()
+	err := m.coll.UpdateOne(ctx, m.idFilter(key), bson.M{
+		"$set": bson.M{"accessed": m.now()},
+	})
+	if err != nil {
+		m.logOp("access", id, err)
+	}
+}
 
-	var modified time.Time
-	if val, ok := session.Values["modified"]; ok {
-		modified, ok = val.(time.Time)
-		if !ok {
-			return errors.New("mongo-store: invalid modified value")
+// find returns the document stored under key, restricted to projection if it
+// is not nil, or ErrSessionNotFound. pref, if not nil, selects the members
+// read from.
+func (m *MongoStore) find(ctx context.Context, key interface{},
+	projection bson.M, pref *readpref.ReadPref) (*Session, error) {
+	if m.ReadConcern != nil || pref != nil {
+		raw, err := m.findConcerned(ctx, key, projection, pref)
+		if err != nil {
+			return nil, err
+		}
+		return m.fromStored(raw)
+	}
+
+	q := m.coll.Find(ctx, m.idFilter(key))
+	if projection != nil {
+		q = q.Select(projection)
+	}
+
+	var raw bson.M
+	err := q.One(&raw)
+	if err == qmgo.ErrNoSuchDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.fromStored(raw)
+}
+
+// expired reports whether the stored session s is past its AbsoluteTimeout or
+// its expires_at. The TTL monitor runs about once a minute, so the document
+// may outlive its expiry for a while.
+func (m *MongoStore) expired(s *Session) bool {
+	now := m.now()
+	if m.AbsoluteTimeout > 0 && !s.Created.IsZero() &&
+		now.Sub(s.Created) > m.AbsoluteTimeout {
+		return true
+	}
+	return !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt)
+}
+
+// legacyExpired reports whether s, with LegacyKidstuffMode, is a legacy
+// document older than MaxAge. Having neither created nor expires_at, it
+// escapes both expired and the TTL index.
+func (m *MongoStore) legacyExpired(s *Session) bool {
+	age := m.maxAge()
+	if !m.LegacyKidstuffMode || !s.Created.IsZero() || !s.ExpiresAt.IsZero() ||
+		age <= 0 {
+		return false
+	}
+	maxAge := time.Duration(ttlSeconds(age)) * time.Second
+	return m.now().Sub(s.Modified) > maxAge
+}
+
+// decode fills session.Values from the stored document s.
+func (m *MongoStore) decode(ctx context.Context, s *Session,
+	session *sessions.Session) error {
+	if s.Data == "" {
+		for k, v := range s.Values {
+			session.Values[k] = v
+		}
+		return nil
+	}
+
+	var data []byte
+	var err error
+	if s.Plain {
+		if data, err = base64.RawURLEncoding.DecodeString(s.Data); err != nil {
+			return err
 		}
 	} else {
-		modified = time.Now()
+		codecs, err := m.payloadCodecs(ctx, session)
+		if err != nil {
+			return err
+		}
+		if err = securecookie.DecodeMulti(session.Name(), s.Data, &data,
+			codecs...); err != nil {
+			// Documents written before the Serializer was introduced, or
+			// by kidstuff/mongostore, hold the values encoded directly by
+			// securecookie.
+			if m.LegacyKidstuffMode {
+				codecs = m.codecs()
+			}
+			if errLegacy := securecookie.DecodeMulti(session.Name(), s.Data,
+				&session.Values, codecs...); errLegacy == nil {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if s.Encrypted {
+		if m.Encrypter == nil {
+			return errors.New("mongo-store: session is encrypted but no " +
+				"Encrypter is set")
+		}
+		if data, err = m.Encrypter.Decrypt(data); err != nil {
+			return err
+		}
+	}
+
+	if s.Compressed {
+		if data, err = decompress(data); err != nil {
+			return err
+		}
+	}
+
+	return m.Serializer.Deserialize(data, session)
+}
+
+// upsert writes session, recording the client of r, which may be nil, if
+// RecordClient is set.
+func (m *MongoStore) upsert(ctx context.Context, r *http.Request,
+	session *sessions.Session) (err error) {
+	m = m.forName(session.Name())
+	ctx, end := m.startOp(ctx, "upsert", session.ID)
+	defer func() {
+		end(err)
+		callHook(m.OnSave, session, err)
+	}()
+
+	s, err := m.document(ctx, session)
+	if err != nil {
+		return err
+	}
+	if m.RecordClient && r != nil {
+		s.IP, s.UserAgent = m.clientIP(r), r.UserAgent()
 	}
 
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		m.Codecs...)
+	_, loaded := session.Values[versionKey{}]
+	err = m.retry(ctx, func(ctx context.Context) error {
+		if m.OptimisticLocking && loaded {
+			return m.writeVersioned(ctx, s)
+		}
+		return m.write(ctx, s)
+	})
+	m.uncache(session.ID)
 	if err != nil {
 		return err
 	}
+	if m.OptimisticLocking {
+		session.Values[versionKey{}] = s.Version
+	}
+	return nil
+}
+
+// versionKey is the session value key under which OptimisticLocking keeps
+// the version a session was loaded at.
+type versionKey struct{}
 
-	oID, err := primitive.ObjectIDFromHex(session.ID)
+// writeVersioned writes the stored document s over the version it was
+// loaded at, one before s.Version.
+func (m *MongoStore) writeVersioned(ctx context.Context, s *Session) error {
+	key, err := m.parseID(s.ID)
 	if err != nil {
 		return err
 	}
 
-	s := Session{
-		ID:       oID,
-		Data:     encoded,
-		Modified: modified,
+	ctx, cancel := m.opContext(ctx)
+	defer cancel()
+	// Documents written without OptimisticLocking have no version, which
+	// a nil guard matches.
+	var version interface{}
+	if s.Version > 1 {
+		version = s.Version - 1
+	}
+	err = m.writeGuarded(ctx, key, bson.M{"version": version}, m.update(s))
+	if err == ErrSessionNotFound {
+		// Deleted, for example by a logout, since it was loaded.
+		return ErrConcurrentModification
+	}
+	return err
+}
+
+// write upserts the stored document s.
+func (m *MongoStore) write(ctx context.Context, s *Session) error {
+	key, err := m.parseID(s.ID)
+	if err != nil {
+		return err
 	}
 
-	_, err = m.coll.UpsertId(context.Background(), s.ID, &s)
+	ctx, cancel := m.opContext(ctx)
+	defer cancel()
+	if m.WriteConcern != nil || m.Unacknowledged {
+		return m.writeConcerned(ctx, key, m.update(s))
+	}
+	err = m.coll.UpdateOne(ctx, m.upsertFilter(key), m.update(s),
+		options.UpdateOptions{
+			UpdateOptions: mongoOpts.Update().SetUpsert(true),
+		})
 	if err != nil {
 		return err
 	}
@@ -210,15 +1246,272 @@ func (m *MongoStore) upsert(session *sessions.Session) error {
 	return nil
 }
 
-func (m *MongoStore) delete(session *sessions.Session) error {
-	if !primitive.IsValidObjectID(session.ID) {
-		return ErrInvalidId
+// update returns the upsert that replaces the stored fields with those of s
+// while keeping the created time of an existing document.
+func (m *MongoStore) update(s *Session) bson.M {
+	f := m.fields()
+	set := bson.M{f.Data: s.Data, f.Modified: s.Modified}
+	unset := bson.M{}
+	optional := []struct {
+		key   string
+		value interface{}
+		empty bool
+	}{
+		{"compressed", s.Compressed, !s.Compressed},
+		{"encrypted", s.Encrypted, !s.Encrypted},
+		{"plain", s.Plain, !s.Plain},
+		{"user_id", s.UserID, s.UserID == ""},
+		{"ip", s.IP, s.IP == ""},
+		{"user_agent", s.UserAgent, s.UserAgent == ""},
+		{"version", s.Version, s.Version == 0},
+		{"expires_at", s.ExpiresAt, s.ExpiresAt.IsZero()},
+		{"values", s.Values, s.Values == nil},
+	}
+	for _, f := range optional {
+		if f.empty {
+			unset[f.key] = ""
+		} else {
+			set[f.key] = f.value
+		}
+	}
+	for _, key := range m.IndexedFields {
+		if val, ok := s.Indexed[key]; ok {
+			set[key] = val
+		} else {
+			unset[key] = ""
+		}
+	}
+
+	created := s.Created
+	if created.IsZero() {
+		created = s.Modified
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"created": created},
+	}
+	if m.LegacyKidstuffMode {
+		// Also fill in the created time legacy documents lack.
+		delete(update, "$setOnInsert")
+		update["$min"] = bson.M{"created": created}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// document builds the stored form of session.
+func (m *MongoStore) document(ctx context.Context,
+	session *sessions.Session) (*Session, error) {
+	_, err := m.parseID(session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The loaded version is not a session value to store.
+	version, ok := session.Values[versionKey{}]
+	if ok {
+		delete(session.Values, versionKey{})
+		defer func() { session.Values[versionKey{}] = version }()
+	}
+
+	modified := m.now()
+	if val, ok := session.Values["modified"]; ok && m.RespectModifiedValue {
+		modified, ok = val.(time.Time)
+		if !ok {
+			return nil, errors.New("mongo-store: invalid modified value")
+		}
+	}
+
+	s := &Session{
+		ID:        session.ID,
+		Modified:  modified,
+		UserID:    m.userID(session),
+		ExpiresAt: m.expiresAt(session, modified),
+	}
+	if m.OptimisticLocking {
+		loaded, _ := version.(int64)
+		s.Version = loaded + 1
+	}
+	if s.Indexed, err = m.indexedFields(session); err != nil {
+		return nil, err
+	}
+
+	if m.RawValues {
+		if s.Values, err = StringKeys(session.Values); err != nil {
+			return nil, err
+		}
+		if m.MaxValueBytes > 0 {
+			raw, err := bson.Marshal(s.Values)
+			if err != nil {
+				return nil, err
+			}
+			if err = m.checkSize(len(raw)); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	data, err := m.Serializer.Serialize(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Compress {
+		if data, err = compress(data); err != nil {
+			return nil, err
+		}
+		s.Compressed = true
+	}
+
+	if m.Encrypter != nil {
+		if data, err = m.Encrypter.Encrypt(data); err != nil {
+			return nil, err
+		}
+		s.Encrypted = true
+	}
+
+	if m.PlainData {
+		s.Data = base64.RawURLEncoding.EncodeToString(data)
+		s.Plain = true
+	} else {
+		codecs, err := m.payloadCodecs(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		s.Data, err = securecookie.EncodeMulti(session.Name(), data,
+			codecs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = m.checkSize(len(s.Data)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkSize returns ErrSessionTooLarge if a payload of n bytes is over
+// MaxValueBytes.
+func (m *MongoStore) checkSize(n int) error {
+	if m.MaxValueBytes > 0 && n > m.MaxValueBytes {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrSessionTooLarge, n,
+			m.MaxValueBytes)
+	}
+	return nil
+}
+
+// expiresAt returns when session expires if written at modified: after the
+// ExpiryFunc lifetime, or else MaxAge seconds later, taken from the
+// session's options or, if that is zero, the store's, less any TTLJitter.
+// It returns the zero time if neither sets a positive MaxAge.
+func (m *MongoStore) expiresAt(session *sessions.Session,
+	modified time.Time) time.Time {
+	var ttl time.Duration
+	if m.ExpiryFunc != nil {
+		ttl = m.ExpiryFunc(session)
+	}
+	if ttl <= 0 {
+		maxAge := m.maxAge()
+		if session.Options != nil && session.Options.MaxAge != 0 {
+			maxAge = session.Options.MaxAge
+		}
+		if maxAge <= 0 {
+			return time.Time{}
+		}
+		ttl = time.Duration(ttlSeconds(maxAge)) * time.Second
+	}
+	if jitter := m.TTLJitter; jitter > 0 {
+		if jitter > ttl {
+			jitter = ttl
+		}
+		ttl -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return modified.Add(ttl)
+}
+
+// userID returns the value stored under UserIDKey formatted as a string, or
+// "" if there is none.
+func (m *MongoStore) userID(session *sessions.Session) string {
+	if m.UserIDKey == "" {
+		return ""
+	}
+	val, ok := session.Values[m.UserIDKey]
+	if !ok || val == nil {
+		return ""
+	}
+	if id, ok := val.(string); ok {
+		return id
+	}
+	return fmt.Sprint(val)
+}
+
+func (m *MongoStore) delete(ctx context.Context,
+	session *sessions.Session) (err error) {
+	m = m.forName(session.Name())
+	defer func() { callHook(m.OnDelete, session, err) }()
+	return m.deleteID(ctx, session.ID)
+}
+
+// callHook calls hook, if set, with the outcome of an operation on session.
+func callHook(hook func(*sessions.Session, error), session *sessions.Session,
+	err error) {
+	if hook != nil {
+		hook(session, err)
 	}
+}
+
+func (m *MongoStore) deleteID(ctx context.Context, id string) (err error) {
+	ctx, end := m.startOp(ctx, "delete", id)
+	defer func() { end(err) }()
 
-	oID, err := primitive.ObjectIDFromHex(session.ID)
+	key, err := m.parseID(id)
 	if err != nil {
 		return err
 	}
 
-	return m.coll.RemoveId(context.Background(), oID)
+	defer m.uncache(id)
+	return m.retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := m.opContext(ctx)
+		defer cancel()
+		if m.capped() {
+			return m.expireCapped(ctx, key)
+		}
+		if m.SoftDelete {
+			return m.tombstone(ctx, key)
+		}
+		if m.WriteConcern != nil || m.Unacknowledged {
+			return m.removeConcerned(ctx, key)
+		}
+		err := m.coll.Remove(ctx, m.idFilter(key))
+		if err == qmgo.ErrNoSuchDocuments {
+			return ErrSessionNotFound
+		}
+		return err
+	})
+}
+
+// contextStore binds a MongoStore to a fixed context so sessions obtained
+// through the registry keep using it for New and Save.
+type contextStore struct {
+	m   *MongoStore
+	ctx context.Context
+}
+
+func (c *contextStore) Get(r *http.Request, name string) (
+	*sessions.Session, error) {
+	return c.m.GetContext(c.ctx, r, name)
+}
+
+func (c *contextStore) New(r *http.Request, name string) (
+	*sessions.Session, error) {
+	return c.m.NewContext(c.ctx, r, name)
+}
+
+func (c *contextStore) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	return c.m.SaveContext(c.ctx, r, w, session)
 }
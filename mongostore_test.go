@@ -1,17 +1,54 @@
 package mongostore
 
 import (
+	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/qiniu/qmgo"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/qiniu/qmgo/options"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongoOpts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/p000ic/go-mongo-store/mongostoretest"
 )
 
+var testHashKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newWeakKeyStore is NewMongoStore with WithWeakKeys, for the tests written
+// before key validation that still use short keys.
+func newWeakKeyStore(c *qmgo.Collection, maxAge int, ensureTTL bool,
+	keyPairs ...[]byte) (*MongoStore, error) {
+	opts := []Option{WithMaxAge(maxAge), WithKeys(keyPairs...), WithWeakKeys()}
+	if ensureTTL {
+		opts = append(opts, WithTTL())
+	}
+	return New(c, opts...)
+}
+
+// mustNewWeakKeyStore is like newWeakKeyStore but panics on error.
+func mustNewWeakKeyStore(c *qmgo.Collection, maxAge int, ensureTTL bool,
+	keyPairs ...[]byte) *MongoStore {
+	store, err := newWeakKeyStore(c, maxAge, ensureTTL, keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
 type FlashMessage struct {
 	Type    int
 	Message string
@@ -57,8 +94,11 @@ func TestMongoStore(t *testing.T) {
 	}
 	defer dbSess.Close(context.Background())
 
-	store := NewMongoStore(dbSess.Database("test").Collection("test_session"), 3600, true,
+	store, err := newWeakKeyStore(dbSess.Database("test").Collection("test_session"), 3600, true,
 		[]byte("secret-key"))
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
 
 	// Round 1 ----------------------------------------------------------------
 
@@ -181,6 +221,1776 @@ func TestMongoStore(t *testing.T) {
 	}
 }
 
-func init() {
-	gob.Register(FlashMessage{})
+// newTestCollection returns an empty, uniquely named collection on the
+// MongoDB deployment at MONGO_TEST_URI, or the local one, and drops it when
+// the test ends. The test is skipped when MongoDB is not reachable.
+func newTestCollection(t *testing.T) *qmgo.Collection {
+	t.Helper()
+	return mongostoretest.NewTestCollection(t)
+}
+
+// saveTestSession saves a new session holding values and returns it along
+// with the Set-Cookie header carrying its token.
+func saveTestSession(t *testing.T, store *MongoStore,
+	values map[interface{}]interface{}) (*sessions.Session, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := httptest.NewRecorder()
+	session, err := store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	if err = store.Save(req, rsp, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	return session, rsp.Header().Get("Set-Cookie")
+}
+
+// saveTestSessionAt is like saveTestSession but saves as if the time were at.
+func saveTestSessionAt(t *testing.T, store *MongoStore, at time.Time,
+	values map[interface{}]interface{}) (*sessions.Session, string) {
+	t.Helper()
+	now := store.Now
+	store.Now = func() time.Time { return at }
+	defer func() { store.Now = now }()
+	return saveTestSession(t, store, values)
+}
+
+// findTestSession returns the document stored for the hex session ID.
+func findTestSession(t *testing.T, coll *qmgo.Collection, id string) Session {
+	t.Helper()
+	oID, _ := primitive.ObjectIDFromHex(id)
+	var s Session
+	if err := coll.Find(context.Background(), bson.M{"_id": oID}).One(&s); err != nil {
+		t.Fatalf("Error finding session %s: %v", id, err)
+	}
+	return s
+}
+
+func TestMongoStoreSameSite(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.Options.SameSite = http.SameSiteStrictMode
+
+	_, cookie := saveTestSession(t, store, nil)
+	if !strings.Contains(cookie, "SameSite=Strict") {
+		t.Errorf("Expected SameSite=Strict; Got %s", cookie)
+	}
+}
+
+func TestMongoStoreSaveContextCanceled(t *testing.T) {
+	store := mustNewWeakKeyStore(newTestCollection(t), 3600, false,
+		[]byte("secret-key"))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := httptest.NewRecorder()
+	session, err := store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.SaveContext(ctx, req, rsp, session)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled; Got %v", err)
+	}
+}
+
+func TestMongoStoreOpTimeout(t *testing.T) {
+	store := mustNewWeakKeyStore(newTestCollection(t), 3600, false,
+		[]byte("secret-key"))
+	session, _ := saveTestSession(t, store, nil)
+
+	store.OpTimeout = time.Nanosecond
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	err := store.Save(req, httptest.NewRecorder(), session)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from upsert; Got %v", err)
+	}
+	err = store.load(context.Background(), session)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from load; Got %v", err)
+	}
+	err = store.delete(context.Background(), session)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from delete; Got %v", err)
+	}
+}
+
+func TestMongoStoreAbsoluteTimeout(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+	store.AbsoluteTimeout = 12 * time.Hour
+
+	created := time.Now().Add(-13 * time.Hour)
+	session, cookie := saveTestSessionAt(t, store, created, nil)
+
+	// A later write refreshes modified but keeps the original created time.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	s := findTestSession(t, coll, session.ID)
+	if time.Since(s.Modified) > time.Minute {
+		t.Errorf("Expected a fresh modified time; Got %v", s.Modified)
+	}
+	if s.Created.Unix() != created.Unix() {
+		t.Errorf("Expected created %v; Got %v", created, s.Created)
+	}
+
+	loaded := sessions.NewSession(store, "session-key")
+	loaded.ID = session.ID
+	if err := store.load(context.Background(), loaded); err != ErrSessionExpired {
+		t.Errorf("Expected ErrSessionExpired; Got %v", err)
+	}
+
+	store.AbsoluteTimeout = 14 * time.Hour
+	if err := store.load(context.Background(), loaded); err != nil {
+		t.Errorf("Expected session within the cap to load; Got %v", err)
+	}
+
+	// Logging in again past the cap starts a session of its own.
+	store.AbsoluteTimeout = 12 * time.Hour
+	req.Header.Add("Cookie", cookie)
+	relogin, err := store.New(req, "session-key")
+	if err != nil || !relogin.IsNew || relogin.ID != "" {
+		t.Fatalf("Expected a new session without an ID; Got %q, %v",
+			relogin.ID, err)
+	}
+	relogin.Values["user"] = "gopher"
+	rsp := httptest.NewRecorder()
+	if err = store.Save(req, rsp, relogin); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if relogin.ID == session.ID {
+		t.Errorf("Expected the new session to get a new ID")
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	loaded, err = store.New(req, "session-key")
+	if err != nil || loaded.IsNew || loaded.Values["user"] != "gopher" {
+		t.Errorf("Expected the new session to load; Got %v, %v",
+			loaded.Values, err)
+	}
+}
+
+func TestMongoStoreNewLoadErrors(t *testing.T) {
+	store := mustNewWeakKeyStore(newTestCollection(t), 3600, false,
+		[]byte("secret-key"))
+	session, cookie := saveTestSession(t, store, nil)
+	if err := store.delete(context.Background(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	// A token for a session that is gone yields a new session.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err := store.New(req, "session-key")
+	if err != nil || !session.IsNew {
+		t.Errorf("Expected a new session without error; Got %v", err)
+	}
+
+	// Other failures, here a cancelled request, are surfaced.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	session, err = store.New(req.WithContext(ctx), "session-key")
+	if !errors.Is(err, context.Canceled) || !session.IsNew {
+		t.Errorf("Expected context.Canceled with a new session; Got %v", err)
+	}
+
+	// Get loads through the registry under the request context too.
+	session, err = store.Get(req.WithContext(ctx), "session-key")
+	if !errors.Is(err, context.Canceled) || !session.IsNew {
+		t.Errorf("Expected context.Canceled from Get; Got %v", err)
+	}
+}
+
+func TestMongoStoreLoadNotFound(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+
+	session := sessions.NewSession(store, "session-key")
+	session.ID = primitive.NewObjectID().Hex()
+	if err := store.load(context.Background(), session); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound; Got %v", err)
+	}
+
+	// A connection failure, here a disconnected client, is not reported as a
+	// missing session.
+	client, disconnected := mongostoretest.Reconnect(t, coll)
+	err := client.Close(context.Background())
+	if err != nil {
+		t.Fatalf("Error disconnecting: %v", err)
+	}
+	if err = store.Ping(context.Background()); err != nil {
+		t.Errorf("Expected ping to succeed; Got %v", err)
+	}
+	store = store.WithCollection(disconnected)
+	if err = store.Ping(context.Background()); err == nil {
+		t.Errorf("Expected ping on a disconnected client to fail")
+	}
+	err = store.load(context.Background(), session)
+	if err == nil || errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected a connection error; Got %v", err)
+	}
+}
+
+func TestMongoStoreWithCollection(t *testing.T) {
+	coll := newTestCollection(t)
+	other := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+	tenant := store.WithCollection(other)
+
+	if tenant.Collection() != other || store.Collection() != coll {
+		t.Errorf("Expected each store to report its own collection")
+	}
+	if tenant.Options != store.Options || &tenant.Codecs[0] != &store.Codecs[0] {
+		t.Errorf("Expected options and codecs to be shared")
+	}
+
+	session, _ := saveTestSession(t, tenant, nil)
+	findTestSession(t, other, session.ID)
+	if n, _ := store.Count(context.Background()); n != 0 {
+		t.Errorf("Expected the original collection to be untouched; Got %d", n)
+	}
+}
+
+func TestValidateKeyPairs(t *testing.T) {
+	hash := bytes.Repeat([]byte("h"), 32)
+	tests := []struct {
+		keyPairs [][]byte
+		ok       bool
+	}{
+		{[][]byte{hash}, true},
+		{[][]byte{hash, bytes.Repeat([]byte("e"), 16)}, true},
+		{[][]byte{hash, bytes.Repeat([]byte("e"), 24)}, true},
+		{[][]byte{hash, bytes.Repeat([]byte("e"), 32)}, true},
+		{[][]byte{hash, nil}, true},
+		{[][]byte{hash, nil, hash, bytes.Repeat([]byte("e"), 32)}, true},
+		{[][]byte{[]byte("secret-key")}, false},
+		{[][]byte{hash, []byte("short")}, false},
+		{[][]byte{hash, nil, []byte("secret-key")}, false},
+	}
+	for i, tt := range tests {
+		err := ValidateKeyPairs(tt.keyPairs...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: Expected ok=%v; Got %v", i, tt.ok, err)
+		}
+		if err != nil && !errors.Is(err, ErrWeakKey) {
+			t.Errorf("%d: Expected ErrWeakKey; Got %v", i, err)
+		}
+	}
+
+	if _, err := NewMongoStore(nil, 3600, false, []byte("secret-key")); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("Expected NewMongoStore to reject a weak key; Got %v", err)
+	}
+}
+
+func TestNewMongoStoreNoKeys(t *testing.T) {
+	if _, err := NewMongoStore(nil, 3600, false); err != ErrNoKeys {
+		t.Errorf("Expected ErrNoKeys; Got %v", err)
+	}
+	if _, err := New(nil); err != ErrNoKeys {
+		t.Errorf("Expected New to require keys too; Got %v", err)
+	}
+
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+	store.AllowWeakKeys = true
+	if err := store.RotateKeys(); err != ErrNoKeys {
+		t.Errorf("Expected RotateKeys to require keys; Got %v", err)
+	}
+}
+
+func TestMongoStoreRotateKeys(t *testing.T) {
+	oldKey := testHashKey
+	newKey := bytes.Repeat([]byte("n"), 32)
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, oldKey)
+
+	_, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	if err := store.RotateKeys([]byte("short")); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("Expected ErrWeakKey; Got %v", err)
+	}
+	if err := store.RotateKeys(newKey, nil, oldKey); err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	rsp := httptest.NewRecorder()
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected old session to decode after rotation; Got %v", err)
+	}
+	if session.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", session.Values["user"])
+	}
+	if err = store.Save(req, rsp, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// The rewritten token and payload only need the new key.
+	if err = store.RotateKeys(newKey); err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected session to decode with the new key; Got %v", err)
+	}
+	if session.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", session.Values["user"])
+	}
+
+	// MaxAge survives rotation. A negative age expires every timestamp, so
+	// decoding fails only if it reached the new codec.
+	store.Options.MaxAge = -1
+	if err = store.RotateKeys(newKey); err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+	encoded, err := store.Codecs[0].Encode("session-key", "x")
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	var v string
+	if err = store.Codecs[0].Decode("session-key", encoded, &v); err == nil {
+		t.Errorf("Expected MaxAge to be applied to the rotated codecs")
+	}
+}
+
+func TestMongoStoreRotateKeysWithCollection(t *testing.T) {
+	oldKey := testHashKey
+	newKey := bytes.Repeat([]byte("n"), 32)
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, oldKey)
+	tenant := store.WithCollection(newTestCollection(t))
+
+	if err := store.RotateKeys(newKey); err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+	token, err := tenant.encodeToken("session-key", "x")
+	if err != nil {
+		t.Fatalf("Error encoding token: %v", err)
+	}
+	var id string
+	if err = securecookie.DecodeMulti("session-key", token, &id,
+		securecookie.CodecsFromPairs(newKey)...); err != nil || id != "x" {
+		t.Errorf("Expected the derived store to use the new key; Got %v", err)
+	}
+}
+
+func TestMongoStoreStringIDs(t *testing.T) {
+	uuid := func() string {
+		return "6ba7b810-9dad-41d1-80b4-" + primitive.NewObjectID().Hex()[12:]
+	}
+
+	for _, stringIDs := range []bool{false, true} {
+		coll := newTestCollection(t)
+		store := MustNewMongoStore(coll, 3600, false, testHashKey)
+		store.StringIDs = stringIDs
+		if stringIDs {
+			store.IDGenerator = uuid
+		}
+
+		session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+			"user": "gopher",
+		})
+		var raw bson.M
+		if err := coll.Find(context.Background(), bson.M{}).One(&raw); err != nil {
+			t.Fatalf("Error finding session: %v", err)
+		}
+		if _, isString := raw["_id"].(string); isString != stringIDs {
+			t.Errorf("StringIDs %v: Got _id %T", stringIDs, raw["_id"])
+		}
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Add("Cookie", cookie)
+		loaded, err := store.New(req, "session-key")
+		if err != nil || loaded.IsNew || loaded.ID != session.ID {
+			t.Fatalf("StringIDs %v: Error loading session: %v", stringIDs, err)
+		}
+		if loaded.Values["user"] != "gopher" {
+			t.Errorf("Expected gopher; Got %v", loaded.Values["user"])
+		}
+		if err = store.DeleteByID(context.Background(), session.ID); err != nil {
+			t.Errorf("StringIDs %v: Error deleting session: %v", stringIDs, err)
+		}
+	}
+
+	// Generated IDs must suit the storage mode.
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.IDGenerator = uuid
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "session-key")
+	if err := store.Save(req, httptest.NewRecorder(), session); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("Expected ErrInvalidId; Got %v", err)
+	}
+}
+
+func TestMongoStoreFieldNames(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.FieldNames = FieldNames{
+		ID:       "session_id",
+		Data:     "session_data",
+		Modified: "session_modified",
+	}
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	oID, _ := primitive.ObjectIDFromHex(session.ID)
+	var raw bson.M
+	if err := coll.Find(context.Background(), bson.M{"session_id": oID}).One(&raw); err != nil {
+		t.Fatalf("Error finding session by renamed id: %v", err)
+	}
+	for _, key := range []string{"session_data", "session_modified"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("Expected field %s; Got %v", key, raw)
+		}
+	}
+	for _, key := range []string{"data", "modified"} {
+		if _, ok := raw[key]; ok {
+			t.Errorf("Expected no field %s; Got %v", key, raw)
+		}
+	}
+	if raw["_id"] == oID {
+		t.Errorf("Expected MongoDB to assign its own _id")
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	loaded, err := store.New(req, "session-key")
+	if err != nil || loaded.IsNew {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if loaded.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", loaded.Values["user"])
+	}
+
+	if err = store.Touch(context.Background(), loaded); err != nil {
+		t.Errorf("Error touching session: %v", err)
+	}
+	if err = store.delete(context.Background(), loaded); err != nil {
+		t.Errorf("Error deleting session: %v", err)
+	}
+	if n, _ := store.Count(context.Background()); n != 0 {
+		t.Errorf("Expected no sessions left; Got %d", n)
+	}
+}
+
+func TestMongoStoreTTLIndex(t *testing.T) {
+	coll := newTestCollection(t)
+	if _, err := newWeakKeyStore(coll, 3600, true, []byte("secret-key")); err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	mc, err := coll.CloneCollection()
+	if err != nil {
+		t.Fatalf("Error cloning collection: %v", err)
+	}
+	cur, err := mc.Indexes().List(context.Background())
+	if err != nil {
+		t.Fatalf("Error listing indexes: %v", err)
+	}
+	var indexes []bson.M
+	if err = cur.All(context.Background(), &indexes); err != nil {
+		t.Fatalf("Error reading indexes: %v", err)
+	}
+	for _, index := range indexes {
+		if key, _ := index["key"].(bson.M); key["expires_at"] == nil {
+			continue
+		}
+		if exp, ok := index["expireAfterSeconds"].(int32); !ok || exp != 0 {
+			t.Fatalf("Expected expireAfterSeconds 0; Got %v",
+				index["expireAfterSeconds"])
+		}
+		return
+	}
+	t.Fatalf("No TTL index on expires_at; Got %v", indexes)
+}
+
+func TestMongoStoreExpiresAt(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	short, err := store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	short.Options.MaxAge = 60
+	if err = store.Save(req, httptest.NewRecorder(), short); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	long, _ := saveTestSession(t, store, nil)
+
+	if s := findTestSession(t, coll, short.ID); !s.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected expires_at %v; Got %v", now.Add(time.Minute), s.ExpiresAt)
+	}
+	if s := findTestSession(t, coll, long.ID); !s.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected expires_at %v; Got %v", now.Add(time.Hour), s.ExpiresAt)
+	}
+
+	// Past its expires_at, the short session no longer loads even though the
+	// TTL monitor has not removed it.
+	now = now.Add(2 * time.Minute)
+	if err = store.load(context.Background(), short); err != ErrSessionExpired {
+		t.Errorf("Expected ErrSessionExpired; Got %v", err)
+	}
+	if err = store.load(context.Background(), long); err != nil {
+		t.Errorf("Expected the long session to load; Got %v", err)
+	}
+}
+
+func TestMongoStoreExpiryFunc(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.ExpiryFunc = func(session *sessions.Session) time.Duration {
+		if session.Values["role"] == "admin" {
+			return 10 * time.Minute
+		}
+		return 0
+	}
+
+	admin, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"role": "admin",
+	})
+	user, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"role": "user",
+	})
+	for _, tt := range []struct {
+		id  string
+		ttl time.Duration
+	}{
+		{admin.ID, 10 * time.Minute},
+		{user.ID, time.Hour},
+	} {
+		s := findTestSession(t, coll, tt.id)
+		if ttl := s.ExpiresAt.Sub(s.Modified); ttl != tt.ttl {
+			t.Errorf("Expected expires_at %v after modified; Got %v", tt.ttl, ttl)
+		}
+	}
+}
+
+func TestMongoStoreEnsureIndexesIdempotent(t *testing.T) {
+	coll := newTestCollection(t)
+	for i := 0; i < 2; i++ {
+		if _, err := NewMongoStore(coll, 3600, true, testHashKey); err != nil {
+			t.Fatalf("Error creating store %d: %v", i, err)
+		}
+	}
+
+	// A TTL index with other options conflicts and is reported.
+	other := newTestCollection(t)
+	exp := int32(60)
+	if err := other.CreateOneIndex(context.Background(), options.IndexModel{
+		Key:          []string{"expires_at"},
+		IndexOptions: &mongoOpts.IndexOptions{ExpireAfterSeconds: &exp},
+	}); err != nil {
+		t.Fatalf("Error creating index: %v", err)
+	}
+	_, err := NewMongoStore(other, 3600, true, testHashKey)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected a conflicting index error; Got %v", err)
+	}
+}
+
+func TestMongoStoreDocumentDBCompat(t *testing.T) {
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+	store.UniqueTTLIndex = true
+	for _, compat := range []bool{false, true} {
+		store.DocumentDBCompat = compat
+		ttl := store.indexModels()[0]
+		if ttl.Key[0] != "expires_at" {
+			t.Fatalf("Expected the TTL index first; Got %v", ttl.Key)
+		}
+		if got := ttl.Sparse != nil || ttl.Unique != nil; got == compat {
+			t.Errorf("DocumentDBCompat %v: Got sparse %v, unique %v", compat,
+				ttl.Sparse, ttl.Unique)
+		}
+	}
+}
+
+func TestMongoStoreTTLIndexNotUnique(t *testing.T) {
+	if ttl := MustNewMongoStore(nil, 3600, false,
+		testHashKey).indexModels()[0]; ttl.Unique != nil {
+		t.Errorf("Expected a non-unique TTL index by default")
+	}
+
+	coll := newTestCollection(t)
+	store, err := NewMongoStore(coll, 3600, true, testHashKey)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	first, _ := saveTestSession(t, store, nil)
+	second, _ := saveTestSession(t, store, nil)
+	for _, id := range []string{first.ID, second.ID} {
+		findTestSession(t, coll, id)
+	}
+}
+
+func TestTTLSeconds(t *testing.T) {
+	tests := []struct {
+		maxAge int
+		want   int32
+	}{
+		{0, 0},
+		{3600, 3600},
+		{86400 * 30, 86400 * 30},
+		{-1, 0},
+		{math.MaxInt32, math.MaxInt32},
+		{math.MaxInt32 + 1, math.MaxInt32},
+	}
+	for _, tt := range tests {
+		if got := ttlSeconds(tt.maxAge); got != tt.want {
+			t.Errorf("ttlSeconds(%d): Expected %d; Got %d", tt.maxAge, tt.want, got)
+		}
+	}
+}
+
+func TestMongoStoreCompress(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+
+	stored := func(compress bool) (Session, string) {
+		store.Compress = compress
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		rsp := httptest.NewRecorder()
+		session, err := store.New(req, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["profile"] = strings.Repeat("cached profile data ", 100)
+		if err = store.Save(req, rsp, session); err != nil {
+			t.Fatalf("Error saving session: %v", err)
+		}
+		return findTestSession(t, coll, session.ID), rsp.Header().Get("Set-Cookie")
+	}
+
+	plain, _ := stored(false)
+	packed, cookie := stored(true)
+	if !packed.Compressed || plain.Compressed {
+		t.Errorf("Expected only the second document to be marked compressed")
+	}
+	if len(packed.Data) >= len(plain.Data) {
+		t.Errorf("Expected compressed data to shrink; Got %d >= %d",
+			len(packed.Data), len(plain.Data))
+	}
+
+	// Compressed and uncompressed documents both load with the option on.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Error loading compressed session: %v", err)
+	}
+	if session.Values["profile"] != strings.Repeat("cached profile data ", 100) {
+		t.Errorf("Unexpected profile value: %v", session.Values["profile"])
+	}
+	session.ID = plain.ID
+	if err = store.load(context.Background(), session); err != nil {
+		t.Errorf("Error loading uncompressed session: %v", err)
+	}
+}
+
+func TestMongoStoreRegenerateID(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	oldID := session.ID
+	created := findTestSession(t, coll, oldID).Created
+	if err := store.RegenerateID(session); err != nil {
+		t.Fatalf("Error regenerating session ID: %v", err)
+	}
+	if session.ID == oldID {
+		t.Fatalf("Expected a new session ID; Got %s", session.ID)
+	}
+
+	oID, _ := primitive.ObjectIDFromHex(oldID)
+	n, err := coll.Find(context.Background(), bson.M{"_id": oID}).Count()
+	if err != nil || n != 0 {
+		t.Errorf("Expected old document to be deleted; Got %d, %v", n, err)
+	}
+
+	loaded := sessions.NewSession(store, "session-key")
+	loaded.ID = session.ID
+	if err := store.load(context.Background(), loaded); err != nil {
+		t.Fatalf("Error loading regenerated session: %v", err)
+	}
+	if loaded.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", loaded.Values["user"])
+	}
+	if s := findTestSession(t, coll, session.ID); !s.Created.Equal(created) {
+		t.Errorf("Expected created %v to carry over; Got %v", created, s.Created)
+	}
+
+	// The old document being gone already does not undo the rotation.
+	gone := session.ID
+	if err = store.DeleteByID(context.Background(), gone); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if err = store.RegenerateID(session); err != nil {
+		t.Errorf("Expected a missing old document to be ignored; Got %v", err)
+	}
+	if session.ID == gone {
+		t.Errorf("Expected a new session ID; Got %s", session.ID)
+	}
+	findTestSession(t, coll, session.ID)
+}
+
+func TestMongoStoreTrackAccess(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, nil)
+
+	loaded := sessions.NewSession(store, "session-key")
+	loaded.ID = session.ID
+	if err := store.load(context.Background(), loaded); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if s := findTestSession(t, coll, session.ID); !s.Accessed.IsZero() {
+		t.Errorf("Expected no accessed time without TrackAccess; Got %v", s.Accessed)
+	}
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	store.TrackAccess = true
+	if err := store.load(context.Background(), loaded); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	// The update is made in the background, so give it a moment.
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := findTestSession(t, coll, session.ID)
+		if s.Accessed.Equal(now) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected accessed %v; Got %v", now, s.Accessed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMongoStoreTouch(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	before := findTestSession(t, coll, session.ID)
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Touch(context.Background(), session); err != nil {
+		t.Fatalf("Error touching session: %v", err)
+	}
+	after := findTestSession(t, coll, session.ID)
+
+	if after.Data != before.Data {
+		t.Errorf("Expected data to be unchanged")
+	}
+	if !after.Modified.After(before.Modified) {
+		t.Errorf("Expected modified to advance; Got %v -> %v",
+			before.Modified, after.Modified)
+	}
+}
+
+func TestMongoStoreRespectModifiedValue(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	values := map[interface{}]interface{}{"modified": "not a time"}
+
+	// By default the value is ordinary session data.
+	session, _ := saveTestSession(t, store, values)
+	if s := findTestSession(t, coll, session.ID); !s.Modified.Equal(now) {
+		t.Errorf("Expected modified %v; Got %v", now, s.Modified)
+	}
+
+	store.RespectModifiedValue = true
+	earlier := now.Add(-time.Hour)
+	session, _ = saveTestSession(t, store, map[interface{}]interface{}{
+		"modified": earlier,
+	})
+	if s := findTestSession(t, coll, session.ID); !s.Modified.Equal(earlier) {
+		t.Errorf("Expected modified %v; Got %v", earlier, s.Modified)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ = store.New(req, "session-key")
+	session.Values["modified"] = "not a time"
+	if err := store.Save(req, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Expected an error for a non-time modified value")
+	}
+}
+
+func TestMongoStoreNow(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+
+	session, _ := saveTestSession(t, store, nil)
+	if s := findTestSession(t, coll, session.ID); !s.Modified.Equal(now) {
+		t.Errorf("Expected modified %v; Got %v", now, s.Modified)
+	}
+
+	now = now.Add(time.Hour)
+	if err := store.Touch(context.Background(), session); err != nil {
+		t.Fatalf("Error touching session: %v", err)
+	}
+	if s := findTestSession(t, coll, session.ID); !s.Modified.Equal(now) {
+		t.Errorf("Expected modified %v; Got %v", now, s.Modified)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if n, err := store.Prune(context.Background(), time.Hour); err != nil || n != 1 {
+		t.Errorf("Expected 1 pruned; Got %d, %v", n, err)
+	}
+}
+
+func TestMongoStoreRawValues(t *testing.T) {
+	coll := newTestCollection(t)
+	store := mustNewWeakKeyStore(coll, 3600, false, []byte("secret-key"))
+	store.RawValues = true
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user":  "gopher",
+		"count": int32(3),
+	})
+
+	s := findTestSession(t, coll, session.ID)
+	if s.Data != "" {
+		t.Errorf("Expected no encoded data; Got %q", s.Data)
+	}
+	if s.Values["user"] != "gopher" || s.Values["count"] != int32(3) {
+		t.Errorf("Expected values subdocument; Got %v", s.Values)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	loaded, err := store.New(req, "session-key")
+	if err != nil || loaded.IsNew {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if loaded.Values["user"] != "gopher" || loaded.Values["count"] != int32(3) {
+		t.Errorf("Unexpected values: %v", loaded.Values)
+	}
+
+	session.Values[42] = "answer"
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err = store.Save(req, httptest.NewRecorder(), session); err == nil {
+		t.Errorf("Expected an error for a non-string key")
+	}
+}
+
+func TestMongoStoreRawValuesTypes(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.RawValues = true
+
+	type cart struct {
+		Items int
+		Note  string `bson:"note_text"`
+	}
+	_, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"small": 3,
+		"large": 1 << 40,
+		"cart":  cart{Items: 2, Note: "gift"},
+	})
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	loaded, err := store.New(req, "session-key")
+	if err != nil || loaded.IsNew {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if v, ok := loaded.Values["small"].(int32); !ok || v != 3 {
+		t.Errorf("Expected int32 3; Got %T %v", loaded.Values["small"],
+			loaded.Values["small"])
+	}
+	if v, ok := loaded.Values["large"].(int64); !ok || v != 1<<40 {
+		t.Errorf("Expected int64 %d; Got %T %v", int64(1<<40),
+			loaded.Values["large"], loaded.Values["large"])
+	}
+	c, ok := loaded.Values["cart"].(bson.M)
+	if !ok {
+		t.Fatalf("Expected the struct as bson.M; Got %T", loaded.Values["cart"])
+	}
+	if c["items"] != int32(2) || c["note_text"] != "gift" {
+		t.Errorf("Expected items and note_text fields; Got %v", c)
+	}
+}
+
+func init() {
+	gob.Register(FlashMessage{})
+	gob.Register(time.Time{})
+}
+
+func TestMongoStoreCapped(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.CappedSize = 1 << 20
+	store.CappedMax = 100
+	if err := store.EnsureIndexes(context.Background()); err != nil {
+		t.Fatalf("Error ensuring indexes: %v", err)
+	}
+
+	db, _ := coll.CloneCollection()
+	var spec struct {
+		Options struct {
+			Capped bool `bson:"capped"`
+		} `bson:"options"`
+	}
+	cur, err := db.Database().ListCollections(context.Background(),
+		bson.M{"name": db.Name()})
+	if err != nil || !cur.Next(context.Background()) {
+		t.Fatalf("Error listing collections: %v", err)
+	}
+	if err = cur.Decode(&spec); err != nil || !spec.Options.Capped {
+		t.Fatalf("Expected a capped collection; Got %+v, %v", spec, err)
+	}
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	id := session.ID
+	session.Options.MaxAge = -1
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if n, _ := store.Count(context.Background()); n != 1 {
+		t.Errorf("Expected the document to be kept; Got %d", n)
+	}
+
+	// A late Touch does not bring the logged-out session back.
+	late := sessions.NewSession(store, "session-key")
+	late.ID = id
+	late.Options = &sessions.Options{MaxAge: 3600}
+	if err = store.Touch(context.Background(), late); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound from Touch; Got %v", err)
+	}
+	if s := findTestSession(t, coll, id); !s.ExpiresAt.Equal(time.Unix(0, 0)) {
+		t.Errorf("Expected the session to stay logged out; Got %v", s.ExpiresAt)
+	}
+
+	req.Header.Add("Cookie", cookie)
+	if session, err = store.New(req, "session-key"); err != nil || !session.IsNew {
+		t.Errorf("Expected a new session after delete; Got %v", err)
+	}
+}
+
+func TestMongoStoreSoftDelete(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.SoftDelete = true
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	var missing string
+	store.OnMissingID = func(id string) { missing = id }
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	id := session.ID
+	session.Options.MaxAge = -1
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	ctx := context.Background()
+	s, err := store.FindSession(ctx, id)
+	if err != nil || s.DeletedAt.IsZero() {
+		t.Fatalf("Expected a tombstone; Got %+v, %v", s, err)
+	}
+	if ok, err := store.Exists(ctx, id); err != nil || ok {
+		t.Errorf("Expected a tombstone not to exist; Got %v, %v", ok, err)
+	}
+	if err = store.DeleteByID(ctx, id); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound deleting twice; Got %v", err)
+	}
+
+	req.Header.Add("Cookie", cookie)
+	if session, err = store.New(req, "session-key"); err != nil || !session.IsNew {
+		t.Errorf("Expected a new session for a replayed token; Got %v", err)
+	}
+	if missing != id {
+		t.Errorf("Expected OnMissingID(%s); Got %q", id, missing)
+	}
+
+	if n, err := store.PurgeDeleted(ctx, time.Hour); n != 0 || err != nil {
+		t.Errorf("Expected the tombstone to be kept; Got %d, %v", n, err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, err := store.PurgeDeleted(ctx, time.Hour); n != 1 || err != nil {
+		t.Errorf("Expected the tombstone to be purged; Got %d, %v", n, err)
+	}
+	if _, err = store.FindSession(ctx, id); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound after purge; Got %v", err)
+	}
+}
+
+func TestMongoStoreSoftDeleteResave(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.SoftDelete = true
+	ctx := context.Background()
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	id := session.ID
+	session.Options.MaxAge = -1
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	// A replayed token gets a fresh session, not the deleted one back.
+	req.Header.Add("Cookie", cookie)
+	replayed, err := store.New(req, "session-key")
+	if err != nil || !replayed.IsNew || replayed.ID != "" {
+		t.Fatalf("Expected a new session without an ID; Got %q, %v",
+			replayed.ID, err)
+	}
+	replayed.Values["user"] = "mallory"
+	if err = store.Save(req, httptest.NewRecorder(), replayed); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if replayed.ID == id {
+		t.Errorf("Expected the resaved session to get a new ID")
+	}
+
+	// Writes straight onto the tombstone's ID fail.
+	stale := sessions.NewSession(store, "session-key")
+	stale.ID = id
+	stale.Options = &sessions.Options{MaxAge: 3600}
+	if err = store.Save(req, httptest.NewRecorder(), stale); err == nil {
+		t.Errorf("Expected a save over the tombstone to fail")
+	}
+	var batchErr *BatchError
+	if err = store.SaveBatch(ctx, []*sessions.Session{stale}); !errors.As(err,
+		&batchErr) {
+		t.Errorf("Expected a BatchError; Got %v", err)
+	}
+	if err = store.Import(ctx, "session-key", id, nil,
+		time.Time{}); err == nil {
+		t.Errorf("Expected an import over the tombstone to fail")
+	}
+
+	s, err := store.FindSession(ctx, id)
+	if err != nil || s.DeletedAt.IsZero() {
+		t.Errorf("Expected the tombstone to survive; Got %+v, %v", s, err)
+	}
+}
+
+func TestNewMongoStoreContextDeadline(t *testing.T) {
+	coll := newTestCollection(t)
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	_, err := NewMongoStoreContext(ctx, coll, 3600, true, testHashKey)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded; Got %v", err)
+	}
+}
+
+func TestMongoStorePlainData(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+
+	encoded, _ := saveTestSession(t, store, map[interface{}]interface{}{"n": 1})
+	store.PlainData = true
+	plain, _ := saveTestSession(t, store, map[interface{}]interface{}{"n": 2})
+	if s := findTestSession(t, coll, plain.ID); !s.Plain {
+		t.Errorf("Expected the document to be marked plain")
+	}
+
+	// Either mode loads what the other wrote.
+	for _, mode := range []bool{true, false} {
+		store.PlainData = mode
+		for want, id := range map[int]string{1: encoded.ID, 2: plain.ID} {
+			values, err := store.FindValues(context.Background(), "session-key", id)
+			if err != nil || values["n"] != want {
+				t.Errorf("PlainData %v: Expected %d; Got %v, %v", mode, want,
+					values["n"], err)
+			}
+		}
+	}
+}
+
+// BenchmarkMongoStoreEncode measures a document and decode round trip. Pooling
+// the gob and gzip buffers (pool.go) changed it, per op, from
+//
+//	PlainData=false/Compress=false   24031 B   269 allocs
+//	PlainData=true/Compress=false    13614 B   213 allocs
+//	PlainData=false/Compress=true  1135142 B   295 allocs
+//
+// to
+//
+//	PlainData=false/Compress=false   23918 B   267 allocs
+//	PlainData=true/Compress=false    13500 B   211 allocs
+//	PlainData=false/Compress=true    17583 B   270 allocs
+//
+// Most of the remaining allocations are in gob and securecookie.
+func BenchmarkMongoStoreEncode(b *testing.B) {
+	for _, tc := range []struct{ plain, compress bool }{
+		{false, false}, {true, false}, {false, true},
+	} {
+		name := fmt.Sprintf("PlainData=%v/Compress=%v", tc.plain, tc.compress)
+		b.Run(name, func(b *testing.B) {
+			store := MustNewMongoStore(nil, 3600, false, testHashKey)
+			store.PlainData = tc.plain
+			store.Compress = tc.compress
+			session := sessions.NewSession(store, "session-key")
+			session.ID = primitive.NewObjectID().Hex()
+			session.Values["user"] = "gopher"
+			session.Values["profile"] = strings.Repeat("cached profile data ", 20)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s, err := store.document(context.Background(), session)
+				if err != nil {
+					b.Fatal(err)
+				}
+				loaded := sessions.NewSession(store, "session-key")
+				if err = store.decode(context.Background(), s, loaded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMongoStoreHooks(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	var events []string
+	hook := func(event string) func(*sessions.Session, error) {
+		return func(session *sessions.Session, err error) {
+			events = append(events, fmt.Sprintf("%s %v", event, err))
+		}
+	}
+	store.OnLoad = hook("load")
+	store.OnSave = hook("save")
+	store.OnDelete = hook("delete")
+
+	session, cookie := saveTestSession(t, store, nil)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if session, _ = store.New(req, "session-key"); session.IsNew {
+		t.Fatal("Expected the saved session")
+	}
+	session.Options.MaxAge = -1
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	store.New(req, "session-key")
+
+	want := []string{"save <nil>", "load <nil>", "delete <nil>",
+		"load " + ErrSessionNotFound.Error()}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected %q; Got %q", want, events)
+	}
+}
+
+func TestMongoStoreOnMissingID(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	var missing []string
+	store.OnMissingID = func(id string) { missing = append(missing, id) }
+
+	session, cookie := saveTestSession(t, store, nil)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	store.New(req, "session-key")
+	if len(missing) != 0 {
+		t.Fatalf("Expected no missing IDs; Got %v", missing)
+	}
+
+	if err := store.DeleteByID(context.Background(), session.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	id := session.ID
+	if session, _ = store.New(req, "session-key"); !session.IsNew {
+		t.Errorf("Expected a new session")
+	}
+	if len(missing) != 1 || missing[0] != id {
+		t.Errorf("Expected %s to be reported missing; Got %v", id, missing)
+	}
+}
+
+func TestMongoStoreMaxValueBytes(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"profile": strings.Repeat("x", 1000),
+	})
+	s, err := store.document(context.Background(), session)
+	if err != nil {
+		t.Fatalf("Error building document: %v", err)
+	}
+
+	store.MaxValueBytes = len(s.Data)
+	saveTestSession(t, store, session.Values)
+
+	store.MaxValueBytes = len(s.Data) - 1
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err = store.Save(req, httptest.NewRecorder(), session); !errors.Is(err,
+		ErrSessionTooLarge) {
+		t.Errorf("Expected ErrSessionTooLarge; Got %v", err)
+	}
+
+	store.RawValues = true
+	store.MaxValueBytes = 100
+	if err = store.Save(req, httptest.NewRecorder(), session); !errors.Is(err,
+		ErrSessionTooLarge) {
+		t.Errorf("Expected ErrSessionTooLarge with RawValues; Got %v", err)
+	}
+}
+
+func TestMongoStoreOptimisticLocking(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	_, cookie := saveTestSession(t, store, map[interface{}]interface{}{"n": 0})
+	store.OptimisticLocking = true
+
+	load := func() *sessions.Session {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Add("Cookie", cookie)
+		session, err := store.New(req, "session-key")
+		if err != nil || session.IsNew {
+			t.Fatalf("Error loading session: %v", err)
+		}
+		return session
+	}
+	save := func(session *sessions.Session) error {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		return store.Save(req, httptest.NewRecorder(), session)
+	}
+
+	first, second := load(), load()
+	first.Values["n"] = 1
+	if err := save(first); err != nil {
+		t.Fatalf("Error saving the first writer: %v", err)
+	}
+	second.Values["n"] = 2
+	if err := save(second); err != ErrConcurrentModification {
+		t.Errorf("Expected ErrConcurrentModification; Got %v", err)
+	}
+
+	// The winner can keep saving and a fresh load sees its write.
+	first.Values["n"] = 3
+	if err := save(first); err != nil {
+		t.Fatalf("Error saving again: %v", err)
+	}
+	if s := findTestSession(t, coll, first.ID); s.Version != 2 {
+		t.Errorf("Expected version 2; Got %d", s.Version)
+	}
+	if n := load().Values["n"]; n != 3 {
+		t.Errorf("Expected 3; Got %v", n)
+	}
+}
+
+func TestMongoStoreDecodeID(t *testing.T) {
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+	id := primitive.NewObjectID().Hex()
+	token, err := securecookie.EncodeMulti("session-key", id, store.Codecs...)
+	if err != nil {
+		t.Fatalf("Error encoding token: %v", err)
+	}
+
+	if got, err := store.DecodeID("session-key", token); err != nil || got != id {
+		t.Errorf("Expected %s; Got %q, %v", id, got, err)
+	}
+	if _, err = store.DecodeID("other-key", token); err == nil {
+		t.Error("Expected an error for a token of another session")
+	}
+	if _, err = store.DecodeID("session-key", "garbage"); err == nil {
+		t.Error("Expected an error for a garbage token")
+	}
+
+	bad, _ := securecookie.EncodeMulti("session-key", "nope", store.Codecs...)
+	if _, err = store.DecodeID("session-key", bad); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("Expected ErrInvalidId; Got %v", err)
+	}
+}
+
+func TestMongoStoreLoadErrorKinds(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	session, cookie := saveTestSession(t, store, nil)
+
+	key, _ := primitive.ObjectIDFromHex(session.ID)
+	if err := coll.UpdateOne(context.Background(), bson.M{"_id": key},
+		bson.M{"$set": bson.M{"data": "corrupted"}}); err != nil {
+		t.Fatalf("Error corrupting session: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if _, err := store.New(req, "session-key"); !errors.Is(err, ErrDecode) ||
+		errors.Is(err, ErrStore) {
+		t.Errorf("Expected ErrDecode for corrupted data; Got %v", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.AddCookie(&http.Cookie{Name: "session-key", Value: "tampered"})
+	if _, err := store.New(req, "session-key"); !errors.Is(err, ErrDecode) {
+		t.Errorf("Expected ErrDecode for a tampered token; Got %v", err)
+	}
+
+	client, disconnected := mongostoretest.Reconnect(t, coll)
+	client.Close(context.Background())
+	closed := store.WithCollection(disconnected)
+	session = sessions.NewSession(closed, "session-key")
+	session.ID = primitive.NewObjectID().Hex()
+	if err := closed.load(context.Background(), session); !errors.Is(err, ErrStore) ||
+		errors.Is(err, ErrDecode) {
+		t.Errorf("Expected ErrStore for a disconnected client; Got %v", err)
+	}
+}
+
+func TestMongoStoreCollectionResolver(t *testing.T) {
+	auth, cart := newTestCollection(t), newTestCollection(t)
+	store := MustNewMongoStore(auth, 3600, false, testHashKey)
+	store.CollectionResolver = func(name string) *qmgo.Collection {
+		if name == "cart" {
+			return cart
+		}
+		return nil
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := httptest.NewRecorder()
+	session, _ := store.New(req, "cart")
+	session.Values["items"] = 3
+	if err := store.Save(req, rsp, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	saveTestSession(t, store, nil)
+	for coll, want := range map[*qmgo.Collection]int64{auth: 1, cart: 1} {
+		if n, _ := coll.Find(context.Background(), bson.M{}).Count(); n != want {
+			t.Errorf("Expected %d session in %s; Got %d", want,
+				coll.GetCollectionName(), n)
+		}
+	}
+
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	session, err := store.New(req, "cart")
+	if err != nil || session.IsNew || session.Values["items"] != 3 {
+		t.Fatalf("Expected the cart session; Got %v, %v", session.Values, err)
+	}
+	session.Options.MaxAge = -1
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if n, _ := cart.Find(context.Background(), bson.M{}).Count(); n != 0 {
+		t.Errorf("Expected the cart session to be deleted; Got %d", n)
+	}
+}
+
+func TestMongoStoreSlideOnLoad(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	now := time.Now().Truncate(time.Millisecond)
+	session, cookie := saveTestSessionAt(t, store, now.Add(-30*time.Minute), nil)
+
+	store.Now = func() time.Time { return now }
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	store.New(req, "session-key")
+	if s := findTestSession(t, coll, session.ID); !s.ExpiresAt.Equal(
+		now.Add(30 * time.Minute)) {
+		t.Fatalf("Expected no sliding without SlideOnLoad; Got %v", s.ExpiresAt)
+	}
+
+	store.SlideOnLoad = true
+	if session, _ = store.New(req, "session-key"); session.IsNew {
+		t.Fatal("Expected the saved session")
+	}
+	s := findTestSession(t, coll, session.ID)
+	if !s.Modified.Equal(now) || !s.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the expiry to slide to %v; Got %v, %v",
+			now.Add(time.Hour), s.Modified, s.ExpiresAt)
+	}
+}
+
+func TestMongoStoreCloseSharedClient(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.TrackAccess = true
+	_, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if _, err := store.New(req, "session-key"); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+	// The update started by the load is done, and the caller's client is
+	// still open.
+	var s Session
+	if err := coll.Find(ctx, bson.M{}).One(&s); err != nil {
+		t.Fatalf("Error finding session after Close: %v", err)
+	}
+	if s.Accessed.IsZero() {
+		t.Errorf("Expected Close to wait for the accessed update")
+	}
+}
+
+func TestMongoStoreTTLJitter(t *testing.T) {
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+	store.TTLJitter = 10 * time.Minute
+	session := sessions.NewSession(store, "session-key")
+	session.Options = store.Options
+
+	modified := time.Now()
+	latest := modified.Add(time.Hour)
+	earliest := latest.Add(-store.TTLJitter)
+	seen := map[time.Time]bool{}
+	for i := 0; i < 50; i++ {
+		expires := store.expiresAt(session, modified)
+		if !expires.After(earliest) || expires.After(latest) {
+			t.Fatalf("Expected expiry in (%v, %v]; Got %v", earliest, latest,
+				expires)
+		}
+		seen[expires] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected jittered expiries to differ")
+	}
+
+	// Sessions without a positive MaxAge have no expiry to jitter.
+	session.Options = &sessions.Options{MaxAge: 0}
+	store.Options.MaxAge = 0
+	if expires := store.expiresAt(session, modified); !expires.IsZero() {
+		t.Errorf("Expected no expiry; Got %v", expires)
+	}
+}
+
+// insertKidstuffSession stores values under a new ID the way
+// kidstuff/mongostore saves a session and returns the Cookie header carrying
+// its token.
+func insertKidstuffSession(t *testing.T, store *MongoStore,
+	coll *qmgo.Collection, modified time.Time,
+	values map[interface{}]interface{}) (primitive.ObjectID, string) {
+	t.Helper()
+	id := primitive.NewObjectID()
+	data, err := securecookie.EncodeMulti("session-key", values,
+		store.Codecs...)
+	if err != nil {
+		t.Fatalf("Error encoding values: %v", err)
+	}
+	if _, err = coll.InsertOne(context.Background(), bson.M{
+		"_id": id, "data": data, "modified": modified,
+	}); err != nil {
+		t.Fatalf("Error inserting legacy session: %v", err)
+	}
+	token, err := securecookie.EncodeMulti("session-key", id.Hex(),
+		store.Codecs...)
+	if err != nil {
+		t.Fatalf("Error encoding token: %v", err)
+	}
+	return id, "session-key=" + token
+}
+
+func TestMongoStoreLegacyKidstuffMode(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	store.LegacyKidstuffMode = true
+
+	id, cookie := insertKidstuffSession(t, store, coll, time.Now(),
+		map[interface{}]interface{}{"user": "gopher"})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected the legacy session; Got %v", err)
+	}
+	if session.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", session.Values["user"])
+	}
+
+	// Saving rewrites it in the current format.
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	s := findTestSession(t, coll, id.Hex())
+	if s.Created.IsZero() || s.ExpiresAt.IsZero() {
+		t.Errorf("Expected created and expires_at to be set; Got %+v", s)
+	}
+	var payload []byte
+	if err = securecookie.DecodeMulti("session-key", s.Data, &payload,
+		store.Codecs...); err != nil {
+		t.Errorf("Expected a Serializer payload; Got %v", err)
+	}
+
+	// Without expires_at, an old legacy session expires by its modified time.
+	_, cookie = insertKidstuffSession(t, store, coll,
+		time.Now().Add(-2*time.Hour), map[interface{}]interface{}{"user": "old"})
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if session, _ = store.New(req, "session-key"); !session.IsNew {
+		t.Errorf("Expected the expired legacy session to be replaced")
+	}
+}
+
+func TestMongoStoreSetTTLNoIndex(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	if err := store.SetTTL(context.Background(), 7200); err != ErrNoTTLIndex {
+		t.Errorf("Expected ErrNoTTLIndex; Got %v", err)
+	}
+	if store.Options.MaxAge != 3600 {
+		t.Errorf("Expected MaxAge unchanged; Got %d", store.Options.MaxAge)
+	}
+}
+
+func TestMongoStoreSetTTL(t *testing.T) {
+	coll := newTestCollection(t)
+	store, err := NewMongoStore(coll, 3600, true, testHashKey)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	derived := store.WithCollection(newTestCollection(t))
+
+	// An index whose expireAfterSeconds drifted is put back.
+	ctx := context.Background()
+	mc, err := coll.CloneCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mc.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: mc.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "keyPattern", Value: bson.D{{Key: "expires_at", Value: 1}}},
+			{Key: "expireAfterSeconds", Value: 60},
+		}},
+	}).Err(); err != nil {
+		t.Fatalf("Error changing the TTL index: %v", err)
+	}
+	_, cookie := saveTestSession(t, store, nil)
+
+	// Requests keep being served while the TTL changes.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Add("Cookie", cookie)
+		for i := 0; i < 20; i++ {
+			_, _ = derived.New(req, "session-key")
+		}
+	}()
+	if err := store.SetTTL(ctx, 7200); err != nil {
+		t.Fatalf("Error setting TTL: %v", err)
+	}
+	<-done
+	if store.maxAge() != 7200 || derived.maxAge() != 7200 {
+		t.Errorf("Expected MaxAge 7200; Got %d and %d", store.maxAge(),
+			derived.maxAge())
+	}
+	if &derived.codecs()[0] != &store.codecs()[0] {
+		t.Errorf("Expected the derived store to get the new codecs")
+	}
+	cur, err := mc.Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("Error listing indexes: %v", err)
+	}
+	var indexes []bson.M
+	if err = cur.All(ctx, &indexes); err != nil {
+		t.Fatalf("Error listing indexes: %v", err)
+	}
+	var exp interface{} = "none"
+	for _, index := range indexes {
+		if key, _ := index["key"].(bson.M); key["expires_at"] != nil {
+			exp = index["expireAfterSeconds"]
+		}
+	}
+	if fmt.Sprint(exp) != "0" {
+		t.Errorf("Expected expireAfterSeconds 0; Got %v", exp)
+	}
+
+	// Tokens issued before still decode, and new saves use the new TTL.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected the saved session; Got %v", err)
+	}
+	if err = store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	s := findTestSession(t, coll, session.ID)
+	if ttl := s.ExpiresAt.Sub(s.Modified); ttl != 2*time.Hour {
+		t.Errorf("Expected expires_at 2h after modified; Got %v", ttl)
+	}
+}
+
+func TestMongoStoreNamespace(t *testing.T) {
+	coll := newTestCollection(t)
+	appA := MustNewMongoStore(coll, 3600, false, testHashKey)
+	appA.Namespace = "a"
+	appB := MustNewMongoStore(coll, 3600, false, testHashKey)
+	appB.Namespace = "b"
+
+	session, cookie := saveTestSession(t, appA, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	if s := findTestSession(t, coll, session.ID); s.Namespace != "a" {
+		t.Errorf("Expected namespace a to be stored; Got %q", s.Namespace)
+	}
+
+	// The same token, valid for both stores' codecs, only loads under a.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	if loaded, _ := appB.New(req, "session-key"); !loaded.IsNew {
+		t.Errorf("Expected b not to find a's session")
+	}
+	if loaded, err := appA.New(req, "session-key"); err != nil || loaded.IsNew {
+		t.Errorf("Expected a to find its session; Got %v", err)
+	}
+
+	ctx := context.Background()
+	if err := appB.DeleteByID(ctx, session.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected b not to delete a's session; Got %v", err)
+	}
+	if n, err := appB.Clear(ctx); err != nil || n != 0 {
+		t.Errorf("Expected b's Clear to leave a's session; Got %d, %v", n, err)
+	}
+	if n, _ := appA.Count(ctx); n != 1 {
+		t.Errorf("Expected a's session to remain; Got %d", n)
+	}
+
+	// b cannot take over the ID either.
+	stolen := sessions.NewSession(appB, "session-key")
+	stolen.ID = session.ID
+	stolen.Values["user"] = "mallory"
+	if err := appB.SaveContext(ctx, req, httptest.NewRecorder(), stolen); err == nil {
+		t.Errorf("Expected b's save over a's ID to fail")
+	}
+	if values, _ := appA.FindValues(ctx, "session-key", session.ID); values["user"] != "gopher" {
+		t.Errorf("Expected a's session untouched; Got %v", values)
+	}
+}
+
+func TestMongoStoreNamespaceSoftDelete(t *testing.T) {
+	coll := newTestCollection(t)
+	appA := MustNewMongoStore(coll, 3600, false, testHashKey)
+	appA.Namespace = "a"
+	appA.SoftDelete = true
+	appB := MustNewMongoStore(coll, 3600, false, testHashKey)
+	appB.Namespace = "b"
+	appB.SoftDelete = true
+
+	ctx := context.Background()
+	deleted, _ := saveTestSession(t, appA, nil)
+	if err := appA.DeleteByID(ctx, deleted.ID); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	live, _ := saveTestSession(t, appA, nil)
+	if err := appB.DeleteByID(ctx, live.ID); err != ErrSessionNotFound {
+		t.Errorf("Expected b not to tombstone a's session; Got %v", err)
+	}
+	if ok, _ := appA.Exists(ctx, live.ID); !ok {
+		t.Errorf("Expected a's session to remain live")
+	}
+
+	if n, err := appB.PurgeDeleted(ctx, -time.Minute); err != nil || n != 0 {
+		t.Errorf("Expected b's purge to leave a's tombstone; Got %d, %v", n, err)
+	}
+	if _, err := appA.FindSession(ctx, deleted.ID); err != nil {
+		t.Errorf("Expected a's tombstone to remain; Got %v", err)
+	}
+	if n, err := appA.PurgeDeleted(ctx, -time.Minute); err != nil || n != 1 {
+		t.Errorf("Expected a's purge to remove its tombstone; Got %d, %v", n, err)
+	}
+}
+
+func TestMongoStoreDeleteWithResult(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	session, _ := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	ctx := context.Background()
+	rsp := httptest.NewRecorder()
+	deleted, err := store.DeleteWithResult(ctx, rsp, session)
+	if err != nil || !deleted {
+		t.Fatalf("Expected the session to be deleted; Got %v, %v", deleted, err)
+	}
+	if cookie := rsp.Header().Get("Set-Cookie"); !strings.Contains(cookie, "Max-Age=0") {
+		t.Errorf("Expected the token to be cleared; Got %q", cookie)
+	}
+	if ok, _ := store.Exists(ctx, session.ID); ok {
+		t.Errorf("Expected the session to be gone")
+	}
+
+	deleted, err = store.DeleteWithResult(ctx, httptest.NewRecorder(), session)
+	if err != nil || deleted {
+		t.Errorf("Expected an already deleted session to report false; Got %v, %v",
+			deleted, err)
+	}
+	unsaved := sessions.NewSession(store, "session-key")
+	unsaved.Options = store.Options
+	deleted, err = store.DeleteWithResult(ctx, httptest.NewRecorder(), unsaved)
+	if err != nil || deleted {
+		t.Errorf("Expected an unsaved session to report false; Got %v, %v",
+			deleted, err)
+	}
+}
+
+func TestMongoStoreDeleteThenGet(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	_, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+
+	// One request logs out and then reads the session again through the
+	// registry, which hands out the same *Session.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	rsp := httptest.NewRecorder()
+	session, err := store.Get(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected the saved session; Got %v", err)
+	}
+	session.Options.MaxAge = -1
+	if err = session.Save(req, rsp); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	again, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !again.IsNew || again.ID != "" || len(again.Values) != 0 {
+		t.Errorf("Expected an empty new session; Got IsNew=%v ID=%q %v",
+			again.IsNew, again.ID, again.Values)
+	}
+	// Saving it again, as middleware saving every session would, keeps the
+	// session deleted.
+	if err = sessions.Save(req, rsp); err != nil {
+		t.Errorf("Error saving after delete: %v", err)
+	}
+	if n, _ := store.Count(context.Background()); n != 0 {
+		t.Errorf("Expected no stored sessions; Got %d", n)
+	}
 }
@@ -0,0 +1,111 @@
+// Package mongostoretest provides MongoDB collections for integration tests
+// of code using mongostore, and of mongostore itself.
+package mongostoretest
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// DefaultURI is the deployment tests use when MONGO_TEST_URI is not set.
+const DefaultURI = "mongodb://localhost:27017"
+
+// defaultDatabase holds the collections when the URI names no database.
+const defaultDatabase = "test"
+
+var (
+	clientsMu sync.Mutex
+	clients   = map[string]*client{}
+)
+
+// client is a connection shared by the tests using the same URI.
+type client struct {
+	once sync.Once
+	cli  *qmgo.Client
+	db   string
+	err  error
+}
+
+// NewTestCollection returns an empty, uniquely named collection on the
+// MongoDB deployment at MONGO_TEST_URI, or DefaultURI if it is not set, in
+// the database the URI names or "test". The collection is dropped when the
+// test ends. The test is skipped if the deployment cannot be reached within
+// a few seconds, so suites still pass where no MongoDB is running.
+//
+// The client is shared by all tests of the process and never closed.
+func NewTestCollection(t testing.TB) *qmgo.Collection {
+	t.Helper()
+	uri := testURI()
+
+	clientsMu.Lock()
+	c, ok := clients[uri]
+	if !ok {
+		c = &client{}
+		clients[uri] = c
+	}
+	clientsMu.Unlock()
+
+	c.once.Do(func() { c.connect(uri) })
+	if c.err != nil {
+		t.Skipf("MongoDB not available at %s: %v", uri, c.err)
+	}
+
+	coll := c.cli.Database(c.db).Collection("test_session_" +
+		primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		_ = coll.DropCollection(context.Background())
+	})
+	return coll
+}
+
+// Reconnect returns coll, a collection made by NewTestCollection, opened
+// through a new client of its own, for tests that close the client or leave
+// replies unread on its connections, as unacknowledged writes do. The client
+// is closed when the test ends, if the test has not closed it already.
+func Reconnect(t testing.TB, coll *qmgo.Collection) (*qmgo.Client,
+	*qmgo.Collection) {
+	t.Helper()
+	c, err := coll.CloneCollection()
+	if err != nil {
+		t.Fatalf("Error cloning collection: %v", err)
+	}
+
+	uri := testURI()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cli, err := qmgo.NewClient(ctx, &qmgo.Config{Uri: uri})
+	if err != nil {
+		t.Skipf("MongoDB not available at %s: %v", uri, err)
+	}
+	t.Cleanup(func() {
+		_ = cli.Close(context.Background())
+	})
+	return cli, cli.Database(c.Database().Name()).Collection(c.Name())
+}
+
+// testURI returns MONGO_TEST_URI, or DefaultURI if it is not set.
+func testURI() string {
+	if uri := os.Getenv("MONGO_TEST_URI"); uri != "" {
+		return uri
+	}
+	return DefaultURI
+}
+
+func (c *client) connect(uri string) {
+	c.db = defaultDatabase
+	if cs, err := connstring.ParseAndValidate(uri); err == nil &&
+		cs.Database != "" {
+		c.db = cs.Database
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c.cli, c.err = qmgo.NewClient(ctx, &qmgo.Config{Uri: uri})
+}
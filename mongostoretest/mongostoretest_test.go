@@ -0,0 +1,55 @@
+package mongostoretest
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNewTestCollection(t *testing.T) {
+	a, b := NewTestCollection(t), NewTestCollection(t)
+	if a.GetCollectionName() == b.GetCollectionName() {
+		t.Errorf("Expected distinct collections; Got %s twice",
+			a.GetCollectionName())
+	}
+
+	ctx := context.Background()
+	if _, err := a.InsertOne(ctx, bson.M{"n": 1}); err != nil {
+		t.Fatalf("Error inserting: %v", err)
+	}
+	if n, err := b.Find(ctx, bson.M{}).Count(); err != nil || n != 0 {
+		t.Errorf("Expected an empty collection; Got %d, %v", n, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	coll := NewTestCollection(t)
+	ctx := context.Background()
+	if _, err := coll.InsertOne(ctx, bson.M{"n": 1}); err != nil {
+		t.Fatalf("Error inserting: %v", err)
+	}
+
+	cli, same := Reconnect(t, coll)
+	if n, err := same.Find(ctx, bson.M{}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected the same collection; Got %d, %v", n, err)
+	}
+	if err := cli.Close(ctx); err != nil {
+		t.Fatalf("Error closing client: %v", err)
+	}
+	if _, err := coll.Find(ctx, bson.M{}).Count(); err != nil {
+		t.Errorf("Expected the shared client to stay open; Got %v", err)
+	}
+}
+
+func TestNewTestCollectionDatabase(t *testing.T) {
+	t.Setenv("MONGO_TEST_URI", DefaultURI+"/mongostoretest")
+	coll := NewTestCollection(t)
+	c, err := coll.CloneCollection()
+	if err != nil {
+		t.Fatalf("Error cloning collection: %v", err)
+	}
+	if name := c.Database().Name(); name != "mongostoretest" {
+		t.Errorf("Expected the database from the URI; Got %s", name)
+	}
+}
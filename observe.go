@@ -0,0 +1,57 @@
+package mongostore
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MetricsObserver receives the outcome of each store operation, so adapters
+// for Prometheus or similar can be plugged in without this package depending
+// on them. op is one of "load", "upsert" or "delete"; err is the error the
+// operation returned, or nil.
+type MetricsObserver interface {
+	ObserveOp(op string, d time.Duration, err error)
+}
+
+// startOp begins the store operation op on the session with the given ID. It
+// returns the context to run the operation under and a function to call with
+// the operation's result.
+func (m *MongoStore) startOp(ctx context.Context, op, id string) (
+	context.Context, func(error)) {
+	start := time.Now()
+	var span trace.Span
+	if m.Tracer != nil {
+		ctx, span = m.Tracer.Start(ctx, "mongostore."+op,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.mongodb.collection", m.collectionName()),
+				attribute.Int("mongostore.session_id.length", len(id)),
+			))
+	}
+
+	return ctx, func(err error) {
+		m.logOp(op, id, err)
+		if m.Metrics != nil {
+			m.Metrics.ObserveOp(op, time.Since(start), err)
+		}
+		if span != nil {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
+
+// collectionName returns the name of the backing collection.
+func (m *MongoStore) collectionName() string {
+	if m.coll == nil {
+		return ""
+	}
+	return m.coll.GetCollectionName()
+}
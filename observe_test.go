@@ -0,0 +1,94 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingTracer records the spans started through it.
+type recordingTracer struct {
+	trace.Tracer
+	names []string
+	attrs [][]attribute.KeyValue
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	r.names = append(r.names, name)
+	cfg := trace.NewSpanStartConfig(opts...)
+	r.attrs = append(r.attrs, cfg.Attributes())
+	return r.Tracer.Start(ctx, name, opts...)
+}
+
+func TestMongoStoreTracer(t *testing.T) {
+	tracer := &recordingTracer{
+		Tracer: trace.NewNoopTracerProvider().Tracer("test"),
+	}
+	store := mustNewWeakKeyStore(nil, 3600, false, []byte("secret-key"))
+	store.Tracer = tracer
+
+	session := sessions.NewSession(store, "session-key")
+	session.ID = "abc"
+	_ = store.load(context.Background(), session)
+	_ = store.upsert(context.Background(), nil, session)
+	_ = store.delete(context.Background(), session)
+
+	want := []string{"mongostore.load", "mongostore.upsert", "mongostore.delete"}
+	if len(tracer.names) != len(want) {
+		t.Fatalf("Expected spans %v; Got %v", want, tracer.names)
+	}
+	for i, name := range want {
+		if tracer.names[i] != name {
+			t.Errorf("Expected span %s; Got %s", name, tracer.names[i])
+		}
+		found := false
+		for _, kv := range tracer.attrs[i] {
+			if kv.Key == "mongostore.session_id.length" && kv.Value.AsInt64() == 3 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected session id length attribute on %s; Got %v",
+				name, tracer.attrs[i])
+		}
+	}
+}
+
+// recordingMetrics records the operations observed through it.
+type recordingMetrics struct {
+	ops  []string
+	errs []error
+}
+
+func (r *recordingMetrics) ObserveOp(op string, d time.Duration, err error) {
+	r.ops = append(r.ops, op)
+	r.errs = append(r.errs, err)
+}
+
+func TestMongoStoreMetrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	store := mustNewWeakKeyStore(nil, 3600, false, []byte("secret-key"))
+	store.Metrics = metrics
+
+	session := sessions.NewSession(store, "session-key")
+	_ = store.load(context.Background(), session)
+	_ = store.upsert(context.Background(), nil, session)
+	_ = store.delete(context.Background(), session)
+
+	want := []string{"load", "upsert", "delete"}
+	if !reflect.DeepEqual(metrics.ops, want) {
+		t.Fatalf("Expected ops %v; Got %v", want, metrics.ops)
+	}
+	for i, err := range metrics.errs {
+		if !errors.Is(err, ErrInvalidId) {
+			t.Errorf("Expected ErrInvalidId for %s; Got %v", want[i], err)
+		}
+	}
+}
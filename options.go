@@ -0,0 +1,121 @@
+package mongostore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/qiniu/qmgo"
+)
+
+// Option configures a MongoStore made by New.
+type Option func(*storeOptions)
+
+// storeOptions collects the Options passed to New.
+type storeOptions struct {
+	maxAge    int
+	ensureTTL bool
+	keyPairs  [][]byte
+	weakKeys  bool
+	// set holds the options applied to the store once it is built.
+	set []func(*MongoStore)
+}
+
+// WithMaxAge sets the MaxAge, in seconds, of sessions and their tokens.
+func WithMaxAge(maxAge int) Option {
+	return func(o *storeOptions) { o.maxAge = maxAge }
+}
+
+// WithTTL creates the indexes, as EnsureIndexes does, so the database removes
+// expired sessions. It is the ensureTTL argument of NewMongoStore.
+func WithTTL() Option {
+	return func(o *storeOptions) { o.ensureTTL = true }
+}
+
+// WithKeys sets the key pairs the payload and tokens are signed and
+// encrypted with, as passed to NewMongoStore.
+func WithKeys(keyPairs ...[]byte) Option {
+	return func(o *storeOptions) { o.keyPairs = keyPairs }
+}
+
+// WithWeakKeys accepts key pairs shorter than ValidateKeyPairs requires, at
+// construction and in RotateKeys, by setting AllowWeakKeys. It is meant for
+// tests using short keys; never use it in production.
+func WithWeakKeys() Option {
+	return func(o *storeOptions) { o.weakKeys = true }
+}
+
+// WithSerializer sets the Serializer of session values.
+func WithSerializer(s Serializer) Option {
+	return func(o *storeOptions) {
+		o.set = append(o.set, func(m *MongoStore) { m.Serializer = s })
+	}
+}
+
+// WithLogger sets the Logger told about every load, upsert and delete.
+func WithLogger(l Logger) Option {
+	return func(o *storeOptions) {
+		o.set = append(o.set, func(m *MongoStore) { m.Logger = l })
+	}
+}
+
+// New returns a new MongoStore configured by opts; it is NewMongoStore with
+// named options in place of positional arguments. The key pairs given with
+// WithKeys are checked with ValidateKeyPairs unless WithWeakKeys is given.
+// Without WithMaxAge sessions expire when the browser closes. Like
+// NewMongoStore, creating the indexes fails after a minute.
+func New(c *qmgo.Collection, opts ...Option) (*MongoStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		defaultIndexTimeout)
+	defer cancel()
+	return newStore(ctx, c, opts...)
+}
+
+// newStore builds the store for New and NewMongoStoreContext, creating the
+// indexes under ctx.
+func newStore(ctx context.Context, c *qmgo.Collection, opts ...Option) (
+	*MongoStore, error) {
+	var o storeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.keyPairs) == 0 {
+		return nil, ErrNoKeys
+	}
+	if !o.weakKeys {
+		if err := ValidateKeyPairs(o.keyPairs...); err != nil {
+			return nil, err
+		}
+	}
+
+	store := &MongoStore{
+		Codecs: securecookie.CodecsFromPairs(o.keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: o.maxAge,
+		},
+		Token:         &CookieToken{},
+		Serializer:    GobSerializer{},
+		UserIDKey:     "user_id",
+		Now:           time.Now,
+		AllowWeakKeys: o.weakKeys,
+		coll:          c,
+		keys:          new(keyring),
+		accessing:     new(sync.WaitGroup),
+	}
+	for _, set := range o.set {
+		set(store)
+	}
+
+	store.MaxAge(o.maxAge)
+
+	if o.ensureTTL {
+		if err := store.EnsureIndexes(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
@@ -0,0 +1,47 @@
+package mongostore
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	logger := log.New(new(bytes.Buffer), "", 0)
+	store, err := New(newTestCollection(t), WithMaxAge(600),
+		WithKeys(testHashKey), WithSerializer(JSONSerializer{}),
+		WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	if store.Options.MaxAge != 600 {
+		t.Errorf("Expected MaxAge 600; Got %d", store.Options.MaxAge)
+	}
+	if _, ok := store.Serializer.(JSONSerializer); !ok {
+		t.Errorf("Expected a JSONSerializer; Got %T", store.Serializer)
+	}
+	if store.Logger != logger {
+		t.Errorf("Expected the logger to be set")
+	}
+
+	if _, err = New(nil, WithKeys([]byte("short"))); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("Expected ErrWeakKey; Got %v", err)
+	}
+}
+
+func TestNewWithWeakKeys(t *testing.T) {
+	store, err := New(nil, WithKeys([]byte("short")), WithWeakKeys())
+	if err != nil {
+		t.Fatalf("Expected a short key to be accepted; Got %v", err)
+	}
+	if !store.AllowWeakKeys {
+		t.Errorf("Expected AllowWeakKeys to be set")
+	}
+	if err = store.RotateKeys([]byte("shorter")); err != nil {
+		t.Errorf("Expected RotateKeys to accept a short key; Got %v", err)
+	}
+	if _, err = New(nil, WithWeakKeys()); err != ErrNoKeys {
+		t.Errorf("Expected ErrNoKeys; Got %v", err)
+	}
+}
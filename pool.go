@@ -0,0 +1,39 @@
+package mongostore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+)
+
+// maxPooledBuffer caps the capacity of buffers put back in bufPool so that a
+// single oversized session does not pin its memory for the life of the pool.
+const maxPooledBuffer = 64 << 10
+
+var (
+	bufPool  = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	// gunzipPool has no New: gzip.NewReader needs a valid header to start.
+	gunzipPool sync.Pool
+)
+
+// getBuffer returns an empty buffer from bufPool.
+func getBuffer() *bytes.Buffer {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to bufPool. Callers must not keep references to its
+// contents, so copy the result out with detach first.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	bufPool.Put(buf)
+}
+
+// detach copies the contents of buf into a slice the caller owns.
+func detach(buf *bytes.Buffer) []byte {
+	return append([]byte(nil), buf.Bytes()...)
+}
@@ -0,0 +1,79 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RetryPolicy controls how load, upsert and delete retry transient Mongo
+// errors such as network failures, elections and write conflicts. Errors
+// like ErrInvalidId or a cancelled context are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries. Zero or one disables
+	// retries.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled before each
+	// further one.
+	Backoff time.Duration
+}
+
+// Server error codes worth retrying: the node is not, or is no longer, the
+// primary, is shutting down, or the write conflicted with another.
+var retryableCodes = []int{
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// isRetryable reports whether err is a transient Mongo error.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") ||
+		se.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range retryableCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls op until it succeeds, fails with an error that is not
+// retryable, or RetryPolicy.MaxAttempts is reached.
+func (m *MongoStore) retry(ctx context.Context,
+	op func(ctx context.Context) error) error {
+	backoff := m.RetryPolicy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if attempt >= m.RetryPolicy.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
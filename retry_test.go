@@ -0,0 +1,57 @@
+package mongostore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// flakyOp fails with err for its first failures calls, then succeeds.
+type flakyOp struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyOp) do(ctx context.Context) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestMongoStoreRetry(t *testing.T) {
+	networkErr := mongo.CommandError{Labels: []string{"NetworkError"}}
+	notPrimary := mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}
+	store := MustNewMongoStore(nil, 3600, false, testHashKey)
+
+	// The default policy makes a single attempt.
+	op := &flakyOp{failures: 1, err: networkErr}
+	if err := store.retry(context.Background(), op.do); err == nil || op.calls != 1 {
+		t.Errorf("Expected one failed attempt; Got %d, %v", op.calls, err)
+	}
+
+	store.RetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	for _, err := range []error{networkErr, notPrimary} {
+		op = &flakyOp{failures: 1, err: err}
+		if err := store.retry(context.Background(), op.do); err != nil || op.calls != 2 {
+			t.Errorf("Expected success on the second attempt; Got %d, %v",
+				op.calls, err)
+		}
+	}
+
+	op = &flakyOp{failures: 5, err: networkErr}
+	if err := store.retry(context.Background(), op.do); err == nil || op.calls != 3 {
+		t.Errorf("Expected 3 failed attempts; Got %d, %v", op.calls, err)
+	}
+
+	for _, err := range []error{ErrInvalidId, ErrSessionNotFound, context.Canceled} {
+		op = &flakyOp{failures: 1, err: err}
+		if got := store.retry(context.Background(), op.do); got != err || op.calls != 1 {
+			t.Errorf("Expected %v without retry; Got %d, %v", err, op.calls, got)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package mongostore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+// Serializer converts session values to and from the bytes stored in MongoDB.
+type Serializer interface {
+	Serialize(session *sessions.Session) ([]byte, error)
+	Deserialize(data []byte, session *sessions.Session) error
+}
+
+// GobSerializer encodes session values with encoding/gob. Custom types must be
+// registered with gob.Register.
+type GobSerializer struct{}
+
+// Serialize encodes session.Values with gob.
+func (s GobSerializer) Serialize(session *sessions.Session) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := gob.NewEncoder(buf).Encode(session.Values); err != nil {
+		return nil, err
+	}
+	return detach(buf), nil
+}
+
+// Deserialize decodes gob data into session.Values.
+func (s GobSerializer) Deserialize(data []byte,
+	session *sessions.Session) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values)
+}
+
+// JSONSerializer encodes session values with encoding/json. Keys must be
+// strings, and values come back as the generic JSON types (map[string]
+// interface{}, []interface{}, float64, string, bool).
+type JSONSerializer struct{}
+
+// Serialize encodes session.Values as a JSON object.
+func (s JSONSerializer) Serialize(session *sessions.Session) ([]byte, error) {
+	values, err := StringKeys(session.Values)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(values)
+}
+
+// Deserialize decodes a JSON object into session.Values.
+func (s JSONSerializer) Deserialize(data []byte,
+	session *sessions.Session) error {
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return nil
+}
+
+// ErrNonStringKey is returned when session values that must be keyed by
+// string have a key of another type.
+var ErrNonStringKey = errors.New("mongo-store: session values must have " +
+	"string keys")
+
+// StringKeySerializer wraps a Serializer, rejecting session values with a key
+// other than a string before they are serialized. Use it with GobSerializer
+// to keep values portable to JSONSerializer and RawValues, which only store
+// string keys. Serializer defaults to GobSerializer.
+type StringKeySerializer struct {
+	Serializer Serializer
+}
+
+func (s StringKeySerializer) serializer() Serializer {
+	if s.Serializer == nil {
+		return GobSerializer{}
+	}
+	return s.Serializer
+}
+
+// Serialize checks that every key of session.Values is a string and then
+// serializes them with the wrapped Serializer.
+func (s StringKeySerializer) Serialize(session *sessions.Session) ([]byte,
+	error) {
+	if _, err := StringKeys(session.Values); err != nil {
+		return nil, err
+	}
+	return s.serializer().Serialize(session)
+}
+
+// Deserialize decodes data with the wrapped Serializer.
+func (s StringKeySerializer) Deserialize(data []byte,
+	session *sessions.Session) error {
+	return s.serializer().Deserialize(data, session)
+}
+
+// StringKeys copies session values into a map keyed by string, as JSON and
+// BSON need, failing with ErrNonStringKey on any other key type.
+func StringKeys(values map[interface{}]interface{}) (map[string]interface{},
+	error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w, got %v (%T)", ErrNonStringKey, k, k)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// InterfaceKeys copies values keyed by string into the map type of
+// sessions.Session.Values, reversing StringKeys.
+func InterfaceKeys(values map[string]interface{}) map[interface{}]interface{} {
+	m := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,136 @@
+package mongostore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestJSONSerializerNestedMap(t *testing.T) {
+	var s JSONSerializer
+	session := sessions.NewSession(nil, "session-key")
+	session.Values["profile"] = map[string]interface{}{
+		"name": "gopher",
+		"tags": []interface{}{"a", "b"},
+		"address": map[string]interface{}{
+			"city": "Berlin",
+		},
+	}
+
+	data, err := s.Serialize(session)
+	if err != nil {
+		t.Fatalf("Error serializing session: %v", err)
+	}
+	decoded := sessions.NewSession(nil, "session-key")
+	if err = s.Deserialize(data, decoded); err != nil {
+		t.Fatalf("Error deserializing session: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Values, session.Values) {
+		t.Errorf("Expected %v; Got %v", session.Values, decoded.Values)
+	}
+}
+
+func TestJSONSerializerNonStringKey(t *testing.T) {
+	var s JSONSerializer
+	session := sessions.NewSession(nil, "session-key")
+	session.Values[42] = "answer"
+
+	if _, err := s.Serialize(session); err == nil {
+		t.Fatalf("Expected an error for a non-string key")
+	}
+}
+
+func TestGobSerializer(t *testing.T) {
+	var s GobSerializer
+	session := sessions.NewSession(nil, "session-key")
+	session.Values["count"] = 3
+	session.Values[1] = &FlashMessage{42, "foo"}
+
+	data, err := s.Serialize(session)
+	if err != nil {
+		t.Fatalf("Error serializing session: %v", err)
+	}
+	decoded := sessions.NewSession(nil, "session-key")
+	if err = s.Deserialize(data, decoded); err != nil {
+		t.Fatalf("Error deserializing session: %v", err)
+	}
+	if decoded.Values["count"] != 3 {
+		t.Errorf("Expected 3; Got %v", decoded.Values["count"])
+	}
+}
+
+func TestGobSerializerPooledBuffers(t *testing.T) {
+	var s GobSerializer
+	first := sessions.NewSession(nil, "session-key")
+	first.Values["user"] = "gopher"
+	data, err := s.Serialize(first)
+	if err != nil {
+		t.Fatalf("Error serializing session: %v", err)
+	}
+	zipped, err := compress(data)
+	if err != nil {
+		t.Fatalf("Error compressing data: %v", err)
+	}
+
+	// Reusing the pooled buffers must not overwrite earlier results.
+	second := sessions.NewSession(nil, "session-key")
+	second.Values["user"] = "someone else entirely"
+	other, err := s.Serialize(second)
+	if err != nil {
+		t.Fatalf("Error serializing session: %v", err)
+	}
+	if _, err = compress(other); err != nil {
+		t.Fatalf("Error compressing data: %v", err)
+	}
+
+	unzipped, err := decompress(zipped)
+	if err != nil {
+		t.Fatalf("Error decompressing data: %v", err)
+	}
+	decoded := sessions.NewSession(nil, "session-key")
+	if err = s.Deserialize(unzipped, decoded); err != nil {
+		t.Fatalf("Error deserializing session: %v", err)
+	}
+	if decoded.Values["user"] != "gopher" {
+		t.Errorf("Expected gopher; Got %v", decoded.Values["user"])
+	}
+}
+
+func TestStringKeySerializer(t *testing.T) {
+	var s StringKeySerializer
+	session := sessions.NewSession(nil, "session-key")
+	session.Values["user"] = "gopher"
+	data, err := s.Serialize(session)
+	if err != nil {
+		t.Fatalf("Error serializing session: %v", err)
+	}
+	decoded := sessions.NewSession(nil, "session-key")
+	if err = s.Deserialize(data, decoded); err != nil {
+		t.Fatalf("Error deserializing session: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Values, session.Values) {
+		t.Errorf("Expected %v; Got %v", session.Values, decoded.Values)
+	}
+
+	session.Values[42] = "answer"
+	if _, err = s.Serialize(session); !errors.Is(err, ErrNonStringKey) {
+		t.Errorf("Expected ErrNonStringKey; Got %v", err)
+	}
+}
+
+func TestStringKeys(t *testing.T) {
+	values := map[interface{}]interface{}{"user": "gopher", "n": 1}
+	strs, err := StringKeys(values)
+	if err != nil {
+		t.Fatalf("Error converting keys: %v", err)
+	}
+	if !reflect.DeepEqual(InterfaceKeys(strs), values) {
+		t.Errorf("Expected %v; Got %v", values, InterfaceKeys(strs))
+	}
+	if _, err = StringKeys(map[interface{}]interface{}{1: "x"}); !errors.Is(err,
+		ErrNonStringKey) {
+		t.Errorf("Expected ErrNonStringKey; Got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package mongostore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// tombstone marks the document under key as deleted at now, for
+// SoftDelete, with the store's WriteConcern, returning ErrSessionNotFound if
+// there is none or it is already a tombstone. An unacknowledged write cannot
+// tell and returns nil.
+func (m *MongoStore) tombstone(ctx context.Context, key interface{}) error {
+	c, err := m.writeCollection()
+	if err != nil {
+		return err
+	}
+	res, err := c.UpdateOne(ctx, m.liveIDFilter(key), bson.M{
+		"$set": bson.M{"deleted_at": m.now()},
+	})
+	if err == mongo.ErrUnacknowledgedWrite {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// findLive is find for sessions that are not SoftDelete tombstones, which
+// it reports as ErrSessionNotFound.
+func (m *MongoStore) findLive(ctx context.Context, key interface{},
+	projection bson.M, pref *readpref.ReadPref) (*Session, error) {
+	if projection != nil {
+		withDeleted := bson.M{"deleted_at": 1}
+		for k, v := range projection {
+			withDeleted[k] = v
+		}
+		projection = withDeleted
+	}
+	s, err := m.find(ctx, key, projection, pref)
+	if err != nil {
+		return nil, err
+	}
+	if !s.DeletedAt.IsZero() {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// findLiveID is findLive for the session ID id.
+func (m *MongoStore) findLiveID(ctx context.Context, id string) (*Session,
+	error) {
+	key, err := m.parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.findLive(ctx, key, nil, nil)
+}
+
+// PurgeDeleted removes the tombstones SoftDelete left more than olderThan
+// ago and returns how many were removed.
+func (m *MongoStore) PurgeDeleted(ctx context.Context,
+	olderThan time.Duration) (int64, error) {
+	res, err := m.coll.RemoveAll(ctx, m.scoped(bson.M{
+		"deleted_at": bson.M{"$lt": m.now().Add(-olderThan)},
+	}))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,18 @@
+package mongostore
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// Store is the session store interface implemented by *MongoStore. Depend on
+// it rather than *MongoStore to swap in another implementation, such as the
+// in-memory one in the memstore package, in tests.
+type Store interface {
+	Get(r *http.Request, name string) (*sessions.Session, error)
+	New(r *http.Request, name string) (*sessions.Session, error)
+	Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error
+}
+
+var _ Store = (*MongoStore)(nil)
@@ -1,18 +1,37 @@
 package mongostore
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/sessions"
 )
 
+// ErrNoToken is returned by HeaderToken.GetToken when the request carries no
+// bearer token.
+var ErrNoToken = errors.New("mongo-store: no token in request header")
+
+// TokenGetSeter moves the encoded session token between the store and the
+// HTTP transport. Implement it to carry sessions in something other than a
+// cookie and assign it to MongoStore.Token.
 type TokenGetSeter interface {
+	// GetToken returns the encoded token for the session called name, or an
+	// error if the request carries none. Any error makes the store start a
+	// new session.
 	GetToken(req *http.Request, name string) (string, error)
+	// SetToken hands the encoded token for the session called name to the
+	// client. An empty value means the session was deleted and the client
+	// should forget the token; options carries the session's MaxAge, Path
+	// and related settings.
 	SetToken(rw http.ResponseWriter, name, value string, options *sessions.Options)
 }
 
+// CookieToken is the default TokenGetSeter. It stores the token in a cookie
+// named after the session, built from the session options.
 type CookieToken struct{}
 
+// GetToken returns the value of the cookie called name.
 func (c *CookieToken) GetToken(req *http.Request, name string) (string, error) {
 	cook, err := req.Cookie(name)
 	if err != nil {
@@ -22,7 +41,113 @@ func (c *CookieToken) GetToken(req *http.Request, name string) (string, error) {
 	return cook.Value, nil
 }
 
+// SetToken sets the cookie called name on the response.
 func (c *CookieToken) SetToken(rw http.ResponseWriter, name, value string,
 	options *sessions.Options) {
 	http.SetCookie(rw, sessions.NewCookie(name, value, options))
 }
+
+const bearerPrefix = "Bearer "
+
+// HeaderToken carries the session token in an HTTP header as
+// "Bearer <token>" instead of a cookie. Header defaults to Authorization.
+type HeaderToken struct {
+	Header string
+}
+
+func (h *HeaderToken) header() string {
+	if h.Header == "" {
+		return "Authorization"
+	}
+	return h.Header
+}
+
+// GetToken returns the bearer token from the configured request header. The
+// session name is not used.
+func (h *HeaderToken) GetToken(req *http.Request, name string) (string, error) {
+	value := req.Header.Get(h.header())
+	if len(value) < len(bearerPrefix) ||
+		!strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+		return "", ErrNoToken
+	}
+
+	token := strings.TrimSpace(value[len(bearerPrefix):])
+	if token == "" {
+		return "", ErrNoToken
+	}
+	return token, nil
+}
+
+// SetToken writes the token to the configured response header, or removes
+// the header when value is empty.
+func (h *HeaderToken) SetToken(rw http.ResponseWriter, name, value string,
+	options *sessions.Options) {
+	if value == "" {
+		rw.Header().Del(h.header())
+		return
+	}
+	rw.Header().Set(h.header(), bearerPrefix+value)
+}
+
+// MultiToken accepts the session token from any of several transports, for
+// example a header from API clients and a cookie from browsers. Tokens are
+// tried in order when reading and the token is written with the first.
+type MultiToken struct {
+	Tokens []TokenGetSeter
+}
+
+// GetToken returns the token of the first of Tokens that finds one, or the
+// last error if none does.
+func (m *MultiToken) GetToken(req *http.Request, name string) (string, error) {
+	err := ErrNoToken
+	for _, t := range m.Tokens {
+		var token string
+		if token, err = t.GetToken(req, name); err == nil {
+			return token, nil
+		}
+	}
+	return "", err
+}
+
+// SetToken hands the token to the client with the first of Tokens.
+func (m *MultiToken) SetToken(rw http.ResponseWriter, name, value string,
+	options *sessions.Options) {
+	if len(m.Tokens) > 0 {
+		m.Tokens[0].SetToken(rw, name, value, options)
+	}
+}
+
+// TokenEncoder is implemented by a TokenGetSeter that turns session IDs into
+// tokens itself. By default the store signs, and with an encryption key
+// encrypts, the ID with its codecs.
+type TokenEncoder interface {
+	// EncodeToken returns the token carrying id for the session called
+	// name.
+	EncodeToken(name, id string) (string, error)
+	// DecodeToken returns the session ID carried by token.
+	DecodeToken(name, token string) (string, error)
+}
+
+// RawToken carries the bare session ID in a cookie, without signing or
+// encrypting it, so it can be read while debugging.
+//
+// WARNING: never use it in production. Anyone who obtains or guesses an ID
+// takes over the session, and the default ObjectID session IDs are
+// predictable, made of a timestamp and a counter. The codecs no longer expire
+// tokens either, so only MaxAge on the stored session applies.
+type RawToken struct {
+	CookieToken
+}
+
+// EncodeToken returns id as it is.
+func (r *RawToken) EncodeToken(name, id string) (string, error) {
+	return id, nil
+}
+
+// DecodeToken returns token as it is.
+func (r *RawToken) DecodeToken(name, token string) (string, error) {
+	if token == "" {
+		return "", ErrNoToken
+	}
+	return token, nil
+}
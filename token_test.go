@@ -0,0 +1,100 @@
+package mongostore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderToken(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+		want   string
+		err    error
+	}{
+		{"", "Bearer abc123", "abc123", nil},
+		{"", "bearer abc123", "abc123", nil},
+		{"", "", "", ErrNoToken},
+		{"", "Basic dXNlcjpwYXNz", "", ErrNoToken},
+		{"", "Bearer ", "", ErrNoToken},
+		{"X-Session-Token", "Bearer xyz", "xyz", nil},
+	}
+	for _, tt := range tests {
+		token := &HeaderToken{Header: tt.header}
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		if tt.value != "" {
+			req.Header.Set(token.header(), tt.value)
+		}
+		got, err := token.GetToken(req, "session-key")
+		if got != tt.want || err != tt.err {
+			t.Errorf("GetToken(%q: %q): Expected %q, %v; Got %q, %v",
+				token.header(), tt.value, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestHeaderTokenSetToken(t *testing.T) {
+	token := &HeaderToken{}
+	rsp := httptest.NewRecorder()
+	token.SetToken(rsp, "session-key", "abc123", nil)
+	if got := rsp.Header().Get("Authorization"); got != "Bearer abc123" {
+		t.Errorf("Expected Bearer abc123; Got %q", got)
+	}
+
+	token.SetToken(rsp, "session-key", "", nil)
+	if got, ok := rsp.Header()["Authorization"]; ok {
+		t.Errorf("Expected header to be removed; Got %q", got)
+	}
+}
+
+func TestMultiToken(t *testing.T) {
+	token := &MultiToken{Tokens: []TokenGetSeter{&HeaderToken{}, &CookieToken{}}}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Set("Authorization", "Bearer from-header")
+	if got, err := token.GetToken(req, "session-key"); got != "from-header" || err != nil {
+		t.Errorf("Expected from-header; Got %q, %v", got, err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.AddCookie(&http.Cookie{Name: "session-key", Value: "from-cookie"})
+	if got, err := token.GetToken(req, "session-key"); got != "from-cookie" || err != nil {
+		t.Errorf("Expected from-cookie; Got %q, %v", got, err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	if _, err := token.GetToken(req, "session-key"); err == nil {
+		t.Error("Expected an error for a request with no token")
+	}
+
+	rsp := httptest.NewRecorder()
+	token.SetToken(rsp, "session-key", "abc123", nil)
+	if got := rsp.Header().Get("Authorization"); got != "Bearer abc123" ||
+		rsp.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Expected only the header to be set; Got %v", rsp.Header())
+	}
+}
+
+func TestMongoStoreRawToken(t *testing.T) {
+	store := MustNewMongoStore(newTestCollection(t), 3600, false, testHashKey)
+	store.Token = &RawToken{}
+
+	session, cookie := saveTestSession(t, store, map[interface{}]interface{}{
+		"user": "gopher",
+	})
+	if want := "session-key=" + session.ID; !strings.HasPrefix(cookie, want) {
+		t.Errorf("Expected the bare ID in %q", cookie)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", cookie)
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew || session.Values["user"] != "gopher" {
+		t.Errorf("Expected the saved session; Got %v, %v", session.Values, err)
+	}
+	if id, err := store.DecodeID("session-key", session.ID); err != nil || id != session.ID {
+		t.Errorf("Expected %s; Got %q, %v", session.ID, id, err)
+	}
+}
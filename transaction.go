@@ -0,0 +1,38 @@
+package mongostore
+
+import (
+	"context"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SaveInTransaction writes session inside the transaction running on sessCtx,
+// so that it commits or aborts together with the caller's other writes, for
+// example marking an order paid and clearing the cart from the session. ctx
+// bounds the write and carries tracing as for SaveContext. A session with a
+// negative MaxAge is deleted instead.
+//
+// Transactions need a replica set or sharded cluster; on a standalone server
+// the write fails. Nothing is retried, since a transient error aborts the
+// whole transaction, which the caller has to run again.
+//
+// No token is written. A new session is given an ID, and the caller must
+// still Save it after the transaction commits for the client to receive it.
+// OnSave runs when the write succeeds, before the commit, and with
+// OptimisticLocking the session keeps the new version even if the
+// transaction later aborts.
+func (m *MongoStore) SaveInTransaction(ctx context.Context,
+	sessCtx mongo.SessionContext, session *sessions.Session) error {
+	tx := *m
+	tx.RetryPolicy = RetryPolicy{}
+	ctx = mongo.NewSessionContext(ctx, sessCtx)
+
+	if session.Options.MaxAge < 0 {
+		return tx.delete(ctx, session)
+	}
+	if session.ID == "" {
+		session.ID = m.newID()
+	}
+	return tx.upsert(ctx, nil, session)
+}
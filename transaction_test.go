@@ -0,0 +1,64 @@
+package mongostore
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMongoStoreSaveInTransaction(t *testing.T) {
+	coll := newTestCollection(t)
+	store := MustNewMongoStore(coll, 3600, false, testHashKey)
+	driverColl, err := coll.CloneCollection()
+	if err != nil {
+		t.Fatalf("Error cloning collection: %v", err)
+	}
+	client := driverColl.Database().Client()
+	ctx := context.Background()
+
+	save := func(session *sessions.Session, commit bool) error {
+		return client.UseSession(ctx, func(sc mongo.SessionContext) error {
+			if err := sc.StartTransaction(); err != nil {
+				return err
+			}
+			if err := store.SaveInTransaction(ctx, sc, session); err != nil {
+				_ = sc.AbortTransaction(ctx)
+				return err
+			}
+			if !commit {
+				return sc.AbortTransaction(ctx)
+			}
+			return sc.CommitTransaction(ctx)
+		})
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, err := store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["cart"] = "empty"
+	if err = save(session, false); err != nil {
+		t.Skipf("Transactions not available: %v", err)
+	}
+	if session.ID == "" {
+		t.Fatalf("Expected the session to be given an ID")
+	}
+	if _, err = store.FindSession(ctx, session.ID); err == nil {
+		// Some servers, FerretDB for one, accept transactions without
+		// rolling them back.
+		t.Skip("Server does not abort transactions")
+	} else if err != ErrSessionNotFound {
+		t.Fatalf("Expected ErrSessionNotFound after abort; Got %v", err)
+	}
+
+	if err = save(session, true); err != nil {
+		t.Fatalf("Error saving in transaction: %v", err)
+	}
+	if s := findTestSession(t, coll, session.ID); s.ID != session.ID {
+		t.Errorf("Expected session %s after commit; Got %s", session.ID, s.ID)
+	}
+}
@@ -0,0 +1,96 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNoTTLIndex is returned by SetTTL when the collection has no TTL index on
+// expires_at.
+var ErrNoTTLIndex = errors.New("mongo-store: no TTL index on expires_at, " +
+	"call EnsureIndexes")
+
+// SetTTL changes the session lifetime of a running store to maxAge seconds:
+// the default Options.MaxAge and the MaxAge the codecs accept tokens for.
+// The codecs are replaced as in RotateKeys, so tokens being decoded are not
+// disturbed, and both changes reach the stores derived with WithCollection.
+// It is safe to call while the store is serving requests.
+//
+// It returns ErrNoTTLIndex, changing nothing, if the TTL index EnsureIndexes
+// creates is missing, as without it stored sessions are never removed.
+// Otherwise it sets the index's expireAfterSeconds with collMod to the 0
+// EnsureIndexes creates it with, since the index expires each document at
+// its own expires_at, which then carries the new lifetime for every session
+// saved from now on. Sessions keep the expiry they were saved with until
+// they are saved again.
+func (m *MongoStore) SetTTL(ctx context.Context, maxAge int) error {
+	ok, err := m.hasTTLIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoTTLIndex
+	}
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return err
+	}
+	err = c.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: c.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "keyPattern", Value: bson.D{{Key: "expires_at", Value: 1}}},
+			{Key: "expireAfterSeconds", Value: 0},
+		}},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("mongo-store: failed to update the TTL index: %w",
+			err)
+	}
+
+	codecs := make([]securecookie.Codec, 0, len(m.codecs()))
+	for _, codec := range m.codecs() {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			cp := *sc
+			codec = cp.MaxAge(maxAge)
+		}
+		codecs = append(codecs, codec)
+	}
+	if m.keys != nil {
+		m.keys.mu.Lock()
+		defer m.keys.mu.Unlock()
+		m.keys.codecs = codecs
+	}
+	m.Codecs = codecs
+	m.Options.MaxAge = maxAge
+	return nil
+}
+
+// hasTTLIndex reports whether the collection has a TTL index on expires_at.
+func (m *MongoStore) hasTTLIndex(ctx context.Context) (bool, error) {
+	c, err := m.coll.CloneCollection()
+	if err != nil {
+		return false, err
+	}
+	cur, err := c.Indexes().List(ctx)
+	if err != nil {
+		return false, err
+	}
+	var indexes []struct {
+		Key                bson.M      `bson:"key"`
+		ExpireAfterSeconds interface{} `bson:"expireAfterSeconds"`
+	}
+	if err = cur.All(ctx, &indexes); err != nil {
+		return false, err
+	}
+	for _, index := range indexes {
+		_, ok := index.Key["expires_at"]
+		if ok && len(index.Key) == 1 && index.ExpireAfterSeconds != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}